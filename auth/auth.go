@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// APIKeyHeader - the header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// ErrNoCredentials - the request didn't carry any credentials
+var ErrNoCredentials = errors.New("Credentials are required, give an API key, bearer token or client certificate")
+
+// Principal - who the request was made by, & the paths they may see
+type Principal struct {
+	Name string `json:"name"`
+	// Method is one of apiKey, jwt or clientCert
+	Method string `json:"method"`
+	// Prefixes are the paths the principal may see, along with everything
+	// beneath them. Without any they may see nothing
+	Prefixes []string `json:"prefixes"`
+	// Admin principals may call the admin endpoints
+	Admin bool `json:"admin"`
+}
+
+type principalKey struct{}
+
+// Auth - authenticates API requests, & works out the paths the caller may see
+type Auth struct {
+	apiKeys     map[string]string
+	jwt         *jwtVerifier
+	clientCerts bool
+	rules       []Rule
+	admins      map[string]bool
+}
+
+// New - creates the authenticator for the configuration
+func New(config *Config) (*Auth, error) {
+	auth := &Auth{
+		apiKeys:     map[string]string{},
+		clientCerts: config.ClientCerts,
+		rules:       config.Rules,
+		admins:      map[string]bool{},
+	}
+	for _, admin := range config.Admins {
+		auth.admins[admin] = true
+	}
+	for _, key := range config.APIKeys {
+		auth.apiKeys[key.Key] = key.Principal
+	}
+	if config.JWT != nil {
+		verifier, err := newJWTVerifier(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		auth.jwt = verifier
+	}
+	return auth, nil
+}
+
+// Authenticate - the principal the request was made by. A verified client
+// certificate is used first, then an API key, then a bearer token. Invalid
+// credentials are an error, even if others would have been valid
+func (a *Auth) Authenticate(r *http.Request) (*Principal, error) {
+	return a.AuthenticateHeaders(r.TLS, r.Header.Get)
+}
+
+// AuthenticateHeaders - the principal for the connection's TLS state, nil
+// when it isn't over TLS, & the headers, looked up by name with header. For
+// callers that aren't HTTP requests, such as gRPC calls with their metadata
+func (a *Auth) AuthenticateHeaders(state *tls.ConnectionState, header func(name string) string) (*Principal, error) {
+	if a.clientCerts && state != nil && len(state.VerifiedChains) > 0 {
+		if name := state.VerifiedChains[0][0].Subject.CommonName; name != "" {
+			return a.principal(name, "clientCert"), nil
+		}
+	}
+
+	if key := header(APIKeyHeader); key != "" {
+		for valid, name := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(valid)) == 1 {
+				return a.principal(name, "apiKey"), nil
+			}
+		}
+		return nil, errors.New("Invalid API key")
+	}
+
+	if authorization := header("Authorization"); a.jwt != nil && strings.HasPrefix(authorization, "Bearer ") {
+		name, err := a.jwt.verify(strings.TrimPrefix(authorization, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		return a.principal(name, "jwt"), nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// principal - the principal with the prefixes its rules, & those for any
+// principal, grant it. Prefixes beneath another it's granted are dropped
+func (a *Auth) principal(name, method string) *Principal {
+	var granted []string
+	for _, rule := range a.rules {
+		if rule.Principal == name || rule.Principal == AnyPrincipal {
+			granted = append(granted, rule.Prefixes...)
+		}
+	}
+	principal := &Principal{Name: name, Method: method, Prefixes: []string{}, Admin: a.admins[name]}
+	for _, prefix := range granted {
+		covered := false
+		for _, other := range granted {
+			if other != prefix && within(prefix, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered && !contains(principal.Prefixes, prefix) {
+			principal.Prefixes = append(principal.Prefixes, prefix)
+		}
+	}
+	return principal
+}
+
+// Unrestricted - whether the principal may see every path. Without a
+// principal, when authentication isn't enabled, every path may be seen
+func (p *Principal) Unrestricted() bool {
+	return p == nil || contains(p.Prefixes, "/")
+}
+
+// Allows - whether the principal may see the path
+func (p *Principal) Allows(folder string) bool {
+	if p.Unrestricted() {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if within(folder, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPrincipal - a context carrying the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext - the principal the context carries, nil when authentication
+// isn't enabled
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// within - whether the folder is the prefix, or beneath it
+func within(folder, prefix string) bool {
+	folder = path.Clean(folder)
+	return prefix == "/" || folder == prefix || strings.HasPrefix(folder, prefix+"/")
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
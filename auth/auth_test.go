@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testConfig - API keys for an office, an admin & someone without any rules
+func testConfig() *Config {
+	return &Config{
+		APIKeys: []APIKey{
+			{Key: "office-key", Principal: "office"},
+			{Key: "admin-key", Principal: "admin"},
+			{Key: "nobody-key", Principal: "nobody"},
+		},
+		Rules: []Rule{
+			{Principal: "office", Prefixes: []string{"/w/2019", "/w/2019/03"}},
+			{Principal: "admin", Prefixes: []string{"/"}},
+			{Principal: AnyPrincipal, Prefixes: []string{"/w/public"}},
+		},
+		Admins: []string{"admin"},
+	}
+}
+
+// authenticate - the principal for a request with the API key
+func authenticate(t *testing.T, a *Auth, apiKey string) (*Principal, error) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/all", nil)
+	if apiKey != "" {
+		r.Header.Set(APIKeyHeader, apiKey)
+	}
+	return a.Authenticate(r)
+}
+
+func TestAPIKeysAuthenticateTheirPrincipal(t *testing.T) {
+	a, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := authenticate(t, a, "office-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "office" || principal.Method != "apiKey" || principal.Admin {
+		t.Errorf("Authenticated as %+v, want office by apiKey", principal)
+	}
+	// the prefix beneath another is dropped, everyone's is added
+	if got := strings.Join(principal.Prefixes, ","); got != "/w/2019,/w/public" {
+		t.Errorf("Granted %s, want /w/2019,/w/public", got)
+	}
+
+	if principal, err := authenticate(t, a, "admin-key"); err != nil || !principal.Admin {
+		t.Errorf("Authenticated as %+v %v, want an admin", principal, err)
+	}
+}
+
+func TestCredentialsMustBeGivenAndValid(t *testing.T) {
+	a, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(t, a, ""); err != ErrNoCredentials {
+		t.Errorf("Without credentials gave %v, want ErrNoCredentials", err)
+	}
+	if principal, err := authenticate(t, a, "guessed"); err == nil {
+		t.Errorf("An invalid key authenticated as %+v", principal)
+	}
+	// a bearer token isn't tried without JWT being configured
+	r := httptest.NewRequest("GET", "/all", nil)
+	r.Header.Set("Authorization", "Bearer anything")
+	if _, err := a.Authenticate(r); err != ErrNoCredentials {
+		t.Errorf("A bearer token gave %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestPrincipalsOnlySeeTheirPrefixes(t *testing.T) {
+	office := &Principal{Name: "office", Prefixes: []string{"/w/2019"}}
+	for folder, want := range map[string]bool{
+		"/w/2019":          true,
+		"/w/2019/a.pdf":    true,
+		"/w/2019/../2019/": true,
+		"/w/2019 old":      false,
+		"/w":               false,
+		"/w/2018/../2019x": false,
+	} {
+		if got := office.Allows(folder); got != want {
+			t.Errorf("Allows(%s) = %t, want %t", folder, got, want)
+		}
+	}
+
+	nobody := &Principal{Name: "nobody", Prefixes: []string{}}
+	if nobody.Allows("/w") || nobody.Unrestricted() {
+		t.Error("A principal without prefixes may see /w")
+	}
+	// without authentication there's no principal, & everything's allowed
+	var none *Principal
+	if !none.Allows("/w") || !none.Unrestricted() {
+		t.Error("Without a principal /w isn't allowed")
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := &Config{
+		APIKeys: []APIKey{{Key: "k", Principal: "a"}, {Key: "k", Principal: "b"}, {Principal: "c"}},
+		JWT:     &JWTConfig{},
+		Rules:   []Rule{{Prefixes: []string{"relative"}}},
+		Admins:  []string{AnyPrincipal},
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("The config was valid")
+	}
+	for _, problem := range []string{
+		"apiKey 2: key is given to another principal",
+		"apiKey 3: key & principal must be set",
+		"jwt: jwksFile must be set",
+		"admin 1: must name a principal",
+		"rule 1: principal must be set",
+		`prefix "relative" must be an absolute path`,
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%v doesn't report %q", err, problem)
+		}
+	}
+
+	if err := (&Config{}).Validate(); err == nil {
+		t.Error("A config without any way to authenticate was valid")
+	}
+}
+
+func TestPrincipalIsCarriedByTheContext(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/all", nil)
+	if FromContext(r.Context()) != nil {
+		t.Error("A principal without authenticating")
+	}
+	principal := &Principal{Name: "office"}
+	if got := FromContext(WithPrincipal(r.Context(), principal)); got != principal {
+		t.Errorf("Carried %+v, want office", got)
+	}
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// AnyPrincipal - a rule for this principal applies to everyone authenticated
+const AnyPrincipal = "*"
+
+// Config - the contents of the API auth file, declaring how callers are
+// authenticated & the watch folder paths each of them may see
+type Config struct {
+	// APIKeys are sent in the X-API-Key header
+	APIKeys []APIKey `yaml:"apiKeys"`
+	// JWT bearer tokens, verified against the keys in a JWKS file
+	JWT *JWTConfig `yaml:"jwt"`
+	// ClientCerts accepts TLS client certificates signed by --api-client-ca,
+	// the principal being the certificate's subject common name
+	ClientCerts bool `yaml:"clientCerts"`
+	// Rules grant principals the paths they may see
+	Rules []Rule `yaml:"rules"`
+	// Admins are the principals who may call the admin endpoints, e.g. to
+	// reload the configuration
+	Admins []string `yaml:"admins"`
+}
+
+// APIKey - a static key & the principal it authenticates as
+type APIKey struct {
+	Key       string `yaml:"key"`
+	Principal string `yaml:"principal"`
+}
+
+// JWTConfig - how bearer tokens are verified
+type JWTConfig struct {
+	// JWKSFile holds the public keys tokens may be signed with
+	JWKSFile string `yaml:"jwksFile"`
+	// Issuer & Audience, when set, must match the token's iss & aud claims
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// PrincipalClaim is the claim naming the principal, defaults to sub
+	PrincipalClaim string `yaml:"principalClaim"`
+}
+
+// Rule - the path prefixes a principal may see, / allowing every path
+type Rule struct {
+	Principal string   `yaml:"principal"`
+	Prefixes  []string `yaml:"prefixes"`
+}
+
+// Load - reads & validates the auth file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read API auth file %s %v", path, err)
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Can't parse API auth file %s %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid API auth file %s %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate - checks the configuration, reporting every problem found
+func (config *Config) Validate() error {
+	var problems []string
+	if len(config.APIKeys) == 0 && config.JWT == nil && !config.ClientCerts {
+		problems = append(problems, "at least one of apiKeys, jwt or clientCerts must be set")
+	}
+	keys := map[string]bool{}
+	for i, key := range config.APIKeys {
+		if key.Key == "" || key.Principal == "" {
+			problems = append(problems, fmt.Sprintf("apiKey %d: key & principal must be set", i+1))
+		}
+		if keys[key.Key] {
+			problems = append(problems, fmt.Sprintf("apiKey %d: key is given to another principal", i+1))
+		}
+		keys[key.Key] = true
+	}
+	if config.JWT != nil && config.JWT.JWKSFile == "" {
+		problems = append(problems, "jwt: jwksFile must be set")
+	}
+	for i, admin := range config.Admins {
+		if admin == "" || admin == AnyPrincipal {
+			problems = append(problems, fmt.Sprintf("admin %d: must name a principal", i+1))
+		}
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Principal == "" {
+			problems = append(problems, fmt.Sprintf("rule %d: principal must be set", i+1))
+		}
+		for j, prefix := range rule.Prefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				problems = append(problems, fmt.Sprintf("rule %d (%s): prefix %q must be an absolute path", i+1, rule.Principal, prefix))
+				continue
+			}
+			rule.Prefixes[j] = path.Clean(prefix)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// the signing algorithms tokens are accepted with, all asymmetric so the JWKS
+// file only ever holds public keys
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// jwtVerifier - verifies bearer tokens against the keys in a JWKS file
+type jwtVerifier struct {
+	config JWTConfig
+	keys   map[string]interface{}
+	parser *jwt.Parser
+}
+
+// jsonWebKey - the fields of a JWK used for RSA & EC public keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWTVerifier(config JWTConfig) (*jwtVerifier, error) {
+	keys, err := loadJWKS(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	if config.PrincipalClaim == "" {
+		config.PrincipalClaim = "sub"
+	}
+	return &jwtVerifier{
+		config: config,
+		keys:   keys,
+		parser: jwt.NewParser(jwt.WithValidMethods(jwtMethods)),
+	}, nil
+}
+
+// verify - the principal the token was issued to, should it be valid. It
+// must expire, as a token that never does can't be withdrawn
+func (v *jwtVerifier) verify(token string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return "", fmt.Errorf("Invalid token %v", err)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", errors.New("Invalid token, it must have an exp claim")
+	}
+	if v.config.Issuer != "" && !claims.VerifyIssuer(v.config.Issuer, true) {
+		return "", errors.New("Invalid token, it wasn't issued by the expected issuer")
+	}
+	if v.config.Audience != "" && !claims.VerifyAudience(v.config.Audience, true) {
+		return "", errors.New("Invalid token, it isn't intended for this audience")
+	}
+	principal, _ := claims[v.config.PrincipalClaim].(string)
+	if principal == "" {
+		return "", fmt.Errorf("Invalid token, it doesn't have a %s claim", v.config.PrincipalClaim)
+	}
+	return principal, nil
+}
+
+// key - the key the token was signed with, by its kid. Tokens without a kid
+// are only accepted when there's a single key
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("No key with ID %q", kid)
+	}
+	return key, nil
+}
+
+// loadJWKS - reads the RSA & EC signing keys from the JWKS file, by key ID
+func loadJWKS(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read JWKS file %s %v", path, err)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("Can't parse JWKS file %s %v", path, err)
+	}
+
+	keys := map[string]interface{}{}
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %d in JWKS file %s %v", i+1, path, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS file %s doesn't hold any signing keys", path)
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("n %v", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("e %v", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("x %v", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("is empty")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
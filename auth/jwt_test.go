@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// testIssuer - the issuer the verifier expects
+const testIssuer = "https://login.example.com/"
+
+// newTestVerifier - a verifier trusting a new key, which is returned to sign
+// tokens with
+func newTestVerifier(t *testing.T) (*jwtVerifier, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinate := func(value []byte) string { return base64.RawURLEncoding.EncodeToString(value) }
+	jwks, err := json.Marshal(map[string][]jsonWebKey{"keys": {{
+		Kty: "EC",
+		Kid: "k1",
+		Use: "sig",
+		Crv: "P-256",
+		X:   coordinate(key.X.FillBytes(make([]byte, 32))),
+		Y:   coordinate(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := newJWTVerifier(JWTConfig{JWKSFile: jwksFile, Issuer: testIssuer, Audience: "tl-watch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier, key
+}
+
+// sign - a token for the claims, signed by the key
+func sign(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims - claims the test verifier accepts
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "office",
+		"iss": testIssuer,
+		"aud": "tl-watch",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifyAcceptsAValidToken(t *testing.T) {
+	verifier, key := newTestVerifier(t)
+	principal, err := verifier.verify(sign(t, key, validClaims()))
+	if err != nil || principal != "office" {
+		t.Errorf("Verified as %q %v, want office", principal, err)
+	}
+}
+
+func TestVerifyRefusesInvalidTokens(t *testing.T) {
+	verifier, key := newTestVerifier(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"without exp": sign(t, key, func() jwt.MapClaims {
+			claims := validClaims()
+			delete(claims, "exp")
+			return claims
+		}()),
+		"expired":        sign(t, key, jwt.MapClaims{"sub": "office", "iss": testIssuer, "aud": "tl-watch", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"other issuer":   sign(t, key, jwt.MapClaims{"sub": "office", "iss": "https://evil.example.com/", "aud": "tl-watch", "exp": time.Now().Add(time.Hour).Unix()}),
+		"other audience": sign(t, key, jwt.MapClaims{"sub": "office", "iss": testIssuer, "aud": "other", "exp": time.Now().Add(time.Hour).Unix()}),
+		"without sub":    sign(t, key, jwt.MapClaims{"iss": testIssuer, "aud": "tl-watch", "exp": time.Now().Add(time.Hour).Unix()}),
+		"other key":      sign(t, otherKey, validClaims()),
+		"unsigned":       strings.Join(strings.Split(sign(t, key, validClaims()), ".")[:2], ".") + ".",
+	} {
+		if principal, err := verifier.verify(token); err == nil {
+			t.Errorf("A token %s was verified as %q", name, principal)
+		}
+	}
+}
+
+func TestVerifyNamesTheMissingExp(t *testing.T) {
+	verifier, key := newTestVerifier(t)
+	claims := validClaims()
+	delete(claims, "exp")
+	if _, err := verifier.verify(sign(t, key, claims)); err == nil || !strings.Contains(err.Error(), "exp") {
+		t.Errorf("Verifying gave %v, want the exp claim named", err)
+	}
+}
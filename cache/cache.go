@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// AllKey - the key the listing of every node is cached under. Every path
+// starts with it, so any change invalidates it
+const AllKey = ""
+
+// Listings - the generation of the index, bumped each time a message is
+// applied to it, & an optional cache of recent folder listings. Listings are
+// only cached for the generation they were read at, & are dropped as soon as
+// a path they could hold changes
+type Listings struct {
+	// epoch tells the generations of different runs apart, as they restart
+	// from 0
+	epoch string
+	size  int
+
+	mu         sync.Mutex
+	generation uint64
+	modified   time.Time
+	entries    map[string]*list.Element
+	recent     *list.List
+}
+
+// Version - the state of the index a listing was read at
+type Version struct {
+	Generation uint64
+	// Modified is when the index last changed, or when the aggregator
+	// started if it hasn't since
+	Modified time.Time
+	epoch    string
+}
+
+type entry struct {
+	key       string
+	fsNodes   []elasticSearch.FsNode
+	totalHits int64
+}
+
+// New - tracks the generation of the index, caching up to size listings. A
+// size of 0 disables the cache
+func New(size int) *Listings {
+	return &Listings{
+		epoch:    fmt.Sprintf("%x", rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()),
+		size:     size,
+		modified: time.Now(),
+		entries:  map[string]*list.Element{},
+		recent:   list.New(),
+	}
+}
+
+// Enabled - whether listings are cached
+func (l *Listings) Enabled() bool {
+	return l.size > 0
+}
+
+// Version - the current state of the index
+func (l *Listings) Version() Version {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Version{Generation: l.generation, Modified: l.modified, epoch: l.epoch}
+}
+
+// Changed - bumps the generation, dropping the cached listings that could
+// hold the paths. Those are the listings of folders the paths start with,
+// matching how the store finds the nodes in a folder, along with those of
+// folders beneath the paths, whose contents go with a folder that's renamed,
+// moved or deleted. Safe to call on nil, for when nothing is served from the
+// index
+func (l *Listings) Changed(paths ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generation++
+	l.modified = time.Now()
+	for key, element := range l.entries {
+		for _, path := range paths {
+			if strings.HasPrefix(path, key) || strings.HasPrefix(key, path) {
+				l.recent.Remove(element)
+				delete(l.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// Get - the cached listing for the key. It's shared, so mustn't be modified
+func (l *Listings) Get(key string) ([]elasticSearch.FsNode, int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	l.recent.MoveToFront(element)
+	cached := element.Value.(*entry)
+	return cached.fsNodes, cached.totalHits, true
+}
+
+// Put - caches the listing read at the version, unless the index has changed
+// since, evicting the least recently used listing when the cache is full
+func (l *Listings) Put(key string, version Version, fsNodes []elasticSearch.FsNode, totalHits int64) {
+	if !l.Enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if version.Generation != l.generation {
+		return
+	}
+	if element, ok := l.entries[key]; ok {
+		element.Value = &entry{key: key, fsNodes: fsNodes, totalHits: totalHits}
+		l.recent.MoveToFront(element)
+		return
+	}
+	l.entries[key] = l.recent.PushFront(&entry{key: key, fsNodes: fsNodes, totalHits: totalHits})
+	if l.recent.Len() > l.size {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// ETag - a weak entity tag for a response at the version. The scope covers
+// whatever else the response depends on, e.g. the request & the caller
+func (v Version) ETag(scope string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(scope))
+	return fmt.Sprintf(`W/"%s-%d-%x"`, v.epoch, v.Generation, hash.Sum64())
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// listing - a listing of a single node at the path
+func listing(fullPath string) []elasticSearch.FsNode {
+	return []elasticSearch.FsNode{{FullPath: fullPath}}
+}
+
+// cached - the keys of the listings that are cached
+func cached(l *Listings, keys ...string) map[string]bool {
+	found := map[string]bool{}
+	for _, key := range keys {
+		_, _, found[key] = l.Get(key)
+	}
+	return found
+}
+
+func TestListingsAreOnlyCachedForTheirVersion(t *testing.T) {
+	l := New(10)
+	stale := l.Version()
+	l.Changed("/w/a.pdf")
+	l.Put("/x", stale, listing("/x/b.pdf"), 1)
+	if _, _, ok := l.Get("/x"); ok {
+		t.Error("A listing read before a change was cached")
+	}
+
+	l.Put("/x", l.Version(), listing("/x/b.pdf"), 1)
+	fsNodes, totalHits, ok := l.Get("/x")
+	if !ok || totalHits != 1 || fsNodes[0].FullPath != "/x/b.pdf" {
+		t.Errorf("Got %v %d %t, want the listing of /x", fsNodes, totalHits, ok)
+	}
+}
+
+func TestChangesDropTheListingsThatCouldHoldThem(t *testing.T) {
+	l := New(10)
+	keys := []string{AllKey, "/w", "/w/2019", "/w/2019/03", "/w/2018", "/x"}
+	for _, key := range keys {
+		l.Put(key, l.Version(), listing(key), 1)
+	}
+	// the folder's renamed, so everything listed beneath it goes too
+	l.Changed("/w/2019")
+	want := map[string]bool{AllKey: false, "/w": false, "/w/2019": false, "/w/2019/03": false, "/w/2018": true, "/x": true}
+	for key, found := range cached(l, keys...) {
+		if found != want[key] {
+			t.Errorf("%q cached %t, want %t", key, found, want[key])
+		}
+	}
+}
+
+func TestTheLeastRecentlyUsedListingIsEvicted(t *testing.T) {
+	l := New(2)
+	l.Put("/a", l.Version(), listing("/a"), 1)
+	l.Put("/b", l.Version(), listing("/b"), 1)
+	l.Get("/a")
+	l.Put("/c", l.Version(), listing("/c"), 1)
+	want := map[string]bool{"/a": true, "/b": false, "/c": true}
+	for key, found := range cached(l, "/a", "/b", "/c") {
+		if found != want[key] {
+			t.Errorf("%s cached %t, want %t", key, found, want[key])
+		}
+	}
+}
+
+func TestADisabledCacheStillVersions(t *testing.T) {
+	l := New(0)
+	before := l.Version()
+	l.Put("/w", before, listing("/w"), 1)
+	if _, _, ok := l.Get("/w"); ok || l.Enabled() {
+		t.Error("A listing was cached with the cache disabled")
+	}
+	l.Changed("/w")
+	if after := l.Version(); after.Generation != before.Generation+1 || after.Modified.Before(before.Modified) {
+		t.Errorf("Changing went from %+v to %+v", before, after)
+	}
+
+	var none *Listings
+	none.Changed("/w")
+}
+
+func TestETagsDifferByVersionScopeAndRun(t *testing.T) {
+	l := New(0)
+	version := l.Version()
+	if version.ETag("/w") != l.Version().ETag("/w") {
+		t.Error("The same version & scope gave different tags")
+	}
+	l.Changed("/w")
+	for name, other := range map[string]string{
+		"another scope":   version.ETag("/x"),
+		"another version": l.Version().ETag("/w"),
+		"another run":     New(0).Version().ETag("/w"),
+	} {
+		if other == version.ETag("/w") {
+			t.Errorf("%s gave the same tag %s", name, other)
+		}
+	}
+}
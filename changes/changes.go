@@ -0,0 +1,92 @@
+package changes
+
+import (
+	"sync"
+	"time"
+)
+
+// Change - a change applied to the index by the message handler
+type Change struct {
+	// Action is the folder watch action, e.g. CREATE
+	Action string
+	// Path is where the node is now, or was when it's deleted
+	Path string
+	// OldPath is where a renamed or moved node was
+	OldPath     string
+	IsDir       bool
+	WatchFolder string
+	Time        time.Time
+}
+
+// Feed - passes the changes applied to the index on to whoever's watching.
+// Publishing never waits on a watcher, one that falls behind is dropped
+// instead, so it can't hold up the messages being handled
+type Feed struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// Subscription - the changes published since subscribing, on C. C is closed
+// once the subscription is closed, or when it falls behind
+type Subscription struct {
+	C <-chan Change
+
+	feed    *Feed
+	changes chan Change
+}
+
+// New - a feed without any subscribers
+func New() *Feed {
+	return &Feed{subscribers: map[*Subscription]bool{}}
+}
+
+// Publish - sends the change to every subscriber, dropping those whose
+// buffer is full. Safe to call on nil, for when nothing is watching
+func (f *Feed) Publish(change Change) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for subscription := range f.subscribers {
+		select {
+		case subscription.changes <- change:
+		default:
+			f.remove(subscription)
+		}
+	}
+}
+
+// Subscribe - subscribes to the changes published from now on, buffering up
+// to buffer of them for the subscriber
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	subscription := &Subscription{feed: f, changes: make(chan Change, buffer)}
+	subscription.C = subscription.changes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[subscription] = true
+	return subscription
+}
+
+// Subscribers - how many are subscribed
+func (f *Feed) Subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+// Close - unsubscribes, safe to call more than once
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	s.feed.remove(s)
+}
+
+// remove - drops the subscription, closing its channel. The feed's lock must
+// be held
+func (f *Feed) remove(subscription *Subscription) {
+	if f.subscribers[subscription] {
+		delete(f.subscribers, subscription)
+		close(subscription.changes)
+	}
+}
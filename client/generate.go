@@ -0,0 +1,5 @@
+package client
+
+// The client is generated from the OpenAPI document the API serves, so
+// regenerate it whenever the document changes
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.5.1 --config=config.yaml ../openapi/openapi.json
@@ -0,0 +1,170 @@
+package compression
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brotliLevel - a middling level, as responses are compressed as they're
+// written rather than ahead of time
+const brotliLevel = 5
+
+// encodings - those responses can be compressed with, most preferred first
+var encodings = []string{"br", "gzip"}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}}
+)
+
+// encoder - a compressing writer that can be reused for another response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Handler - compresses responses with brotli or gzip, whichever the caller
+// prefers of those its Accept-Encoding allows. Responses that are already
+// encoded, or have no body, are left alone. Streamed responses are compressed
+// as they're written
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writer := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer writer.Close()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// negotiate - the encoding to use of those the Accept-Encoding header allows,
+// empty for none
+func negotiate(header string) string {
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		if q := quality(header, encoding); q > bestQuality {
+			best, bestQuality = encoding, q
+		}
+	}
+	return best
+}
+
+// quality - the q value the header gives the encoding, 0 when it's not
+// accepted
+func quality(header, encoding string) float64 {
+	wildcard := 0.0
+	for _, accepted := range strings.Split(header, ",") {
+		params := strings.Split(accepted, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		switch name {
+		case encoding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// compressWriter - compresses the response, once its status & headers show
+// it should be
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     encoder
+	wroteHeader bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	if status < http.StatusOK {
+		// informational responses come before the real one
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.wroteHeader = true
+	header := c.ResponseWriter.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		if c.encoding == "br" {
+			c.encoder = brotliWriters.Get().(encoder)
+		} else {
+			c.encoder = gzipWriters.Get().(encoder)
+		}
+		c.encoder.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(data []byte) (int, error) {
+	if !c.wroteHeader {
+		// sniffed from the uncompressed body, as it would have been
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoder == nil {
+		return c.ResponseWriter.Write(data)
+	}
+	return c.encoder.Write(data)
+}
+
+// Flush - flushes what's been compressed so far, for responses that are
+// streamed
+func (c *compressWriter) Flush() {
+	if c.encoder != nil {
+		c.encoder.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap - the response being compressed, for http.ResponseController
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Close - finishes the compressed body, returning the encoder for reuse
+func (c *compressWriter) Close() error {
+	if c.encoder == nil {
+		return nil
+	}
+	err := c.encoder.Close()
+	c.encoder.Reset(nil)
+	if c.encoding == "br" {
+		brotliWriters.Put(c.encoder)
+	} else {
+		gzipWriters.Put(c.encoder)
+	}
+	c.encoder = nil
+	return err
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/streadway/amqp"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config - the contents of the aggregator's configuration file, which can be
+// reloaded whilst running
+type Config struct {
+	// LogLevel overrides the level set by --dev / --verbose, e.g. debug
+	LogLevel string `yaml:"logLevel"`
+	// HandlerTimeout overrides --handler-timeout for bindings without their
+	// own timeout
+	HandlerTimeout time.Duration `yaml:"handlerTimeout"`
+	Bindings       []Binding     `yaml:"bindings"`
+}
+
+// Binding - declares a queue, what it's bound to on which exchange, & the
+// handler that processes its messages
+type Binding struct {
+	// Name identifies the binding in logs / errors, defaults to the queue name
+	Name string `yaml:"name"`
+	// Exchange the queue is bound to (the stream for NATS, unused by Kafka).
+	// When ExchangeType is set the exchange is declared, otherwise it must
+	// already exist
+	Exchange     string `yaml:"exchange"`
+	ExchangeType string `yaml:"exchangeType"`
+	Queue        string `yaml:"queue"`
+	// RoutingKeys the queue is bound to the exchange with (the subjects for
+	// NATS, topics for Kafka)
+	RoutingKeys []string `yaml:"routingKeys"`
+	// Handler is the name of a registered message handler
+	Handler string `yaml:"handler"`
+	// Durable defaults to true, so that queues survive a broker restart
+	Durable    *bool `yaml:"durable"`
+	AutoDelete bool  `yaml:"autoDelete"`
+	// MessageTTL, DeadLetterExchange, DeadLetterRoutingKey & MaxLength are
+	// shorthand for the common queue arguments
+	MessageTTL           time.Duration `yaml:"messageTTL"`
+	DeadLetterExchange   string        `yaml:"deadLetterExchange"`
+	DeadLetterRoutingKey string        `yaml:"deadLetterRoutingKey"`
+	MaxLength            int           `yaml:"maxLength"`
+	// Arguments are any other queue arguments, e.g. x-queue-mode
+	Arguments map[string]interface{} `yaml:"arguments"`
+	// Timeout for processing a single message, defaults to --handler-timeout
+	Timeout time.Duration `yaml:"timeout"`
+	// Workers & Prefetch default to --rabbit-mq-workers & --rabbit-mq-prefetch
+	Workers  int `yaml:"workers"`
+	Prefetch int `yaml:"prefetch"`
+}
+
+// Load - reads & validates the configuration file, handlers being the names
+// of the message handlers bindings can refer to
+func Load(path string, handlers []string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read config file %s %v", path, err)
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Can't parse config file %s %v", path, err)
+	}
+	if err := config.Validate(handlers); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate - checks the configuration, reporting every problem found
+func (config *Config) Validate(handlers []string) error {
+	var problems []string
+	if config.LogLevel != "" {
+		if _, err := zerolog.ParseLevel(config.LogLevel); err != nil {
+			problems = append(problems, fmt.Sprintf("logLevel %q isn't a log level", config.LogLevel))
+		}
+	}
+	if config.HandlerTimeout < 0 {
+		problems = append(problems, "handlerTimeout can't be negative")
+	}
+	names := map[string]bool{}
+	for i := range config.Bindings {
+		binding := &config.Bindings[i]
+		if binding.Name == "" {
+			binding.Name = binding.Queue
+		}
+		for _, err := range binding.validate(handlers) {
+			problems = append(problems, fmt.Sprintf("binding %d (%s): %v", i+1, binding.Name, err))
+		}
+		if binding.Name != "" {
+			if names[binding.Name] {
+				problems = append(problems, fmt.Sprintf("binding %d (%s): name is used by another binding", i+1, binding.Name))
+			}
+			names[binding.Name] = true
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (binding *Binding) validate(handlers []string) []error {
+	var errs []error
+	if binding.Exchange == "" {
+		errs = append(errs, errors.New("exchange must be set"))
+	}
+	if binding.Queue == "" {
+		errs = append(errs, errors.New("queue must be set"))
+	}
+	if len(binding.RoutingKeys) == 0 {
+		errs = append(errs, errors.New("at least one routing key must be set"))
+	}
+	if !contains(handlers, binding.Handler) {
+		errs = append(errs, fmt.Errorf("handler %q isn't one of %s", binding.Handler, strings.Join(handlers, ", ")))
+	}
+	if binding.MessageTTL < 0 || binding.Timeout < 0 || binding.MaxLength < 0 ||
+		binding.Workers < 0 || binding.Prefetch < 0 {
+		errs = append(errs, errors.New("messageTTL, timeout, maxLength, workers & prefetch can't be negative"))
+	}
+	if binding.MessageTTL%time.Millisecond != 0 {
+		errs = append(errs, errors.New("messageTTL must be a whole number of milliseconds"))
+	}
+	if err := binding.QueueArguments().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("arguments %v", err))
+	}
+	return errs
+}
+
+// IsDurable - whether the queue (and exchange, if declared) survive a restart
+func (binding Binding) IsDurable() bool {
+	return binding.Durable == nil || *binding.Durable
+}
+
+// QueueArguments - the arguments the queue is declared with
+func (binding Binding) QueueArguments() amqp.Table {
+	args := amqp.Table{}
+	for key, value := range binding.Arguments {
+		args[key] = value
+	}
+	if binding.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(binding.MessageTTL / time.Millisecond)
+	}
+	if binding.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = binding.DeadLetterExchange
+	}
+	if binding.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = binding.DeadLetterRoutingKey
+	}
+	if binding.MaxLength > 0 {
+		args["x-max-length"] = int64(binding.MaxLength)
+	}
+	return args
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
+)
+
+// subscribeWait - how often PublishWhenSubscribed checks for a subscriber
+const subscribeWait = 100 * time.Millisecond
+
+var (
+	// ErrNoSubscribers - nothing is subscribed to the message's routing key
+	ErrNoSubscribers = errors.New("No bindings are subscribed to the routing key")
+	// ErrRejected - a handler failed to process the message
+	ErrRejected = errors.New("The message was rejected by a handler")
+)
+
+// Channel - an in-process source, for running the handler pipeline without
+// a broker. Each message published is delivered to every binding subscribed
+// to its routing key
+type Channel struct {
+	mu            sync.RWMutex
+	subscriptions map[*channelSubscription]bool
+}
+
+// NewChannel - creates an in-process source
+func NewChannel() *Channel {
+	return &Channel{}
+}
+
+func (ch *Channel) String() string {
+	return "in-process"
+}
+
+// Connect - there's nothing to connect to, so it never fails
+func (ch *Channel) Connect() (<-chan error, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.subscriptions = map[*channelSubscription]bool{}
+	return make(chan error), nil
+}
+
+// Close - stops every subscription, closing their deliveries channels
+func (ch *Channel) Close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for sub := range ch.subscriptions {
+		sub.Stop()
+	}
+	ch.subscriptions = nil
+	return nil
+}
+
+// Subscribe - delivers messages published with any of the binding's routing
+// keys
+func (ch *Channel) Subscribe(binding Binding) (Subscription, error) {
+	sub := &channelSubscription{
+		source:     ch,
+		binding:    binding,
+		deliveries: make(chan Delivery),
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.subscriptions == nil {
+		return nil, errors.New("The in-process source isn't connected")
+	}
+	ch.subscriptions[sub] = true
+	return sub, nil
+}
+
+// Publish - delivers the message to every binding subscribed to the routing
+// key, waiting until they've all processed it. Returns the handler's error
+// should any fail
+func (ch *Channel) Publish(ctx context.Context, key string, body []byte) error {
+	var subscribed []*channelSubscription
+	ch.mu.RLock()
+	for sub := range ch.subscriptions {
+		if sub.boundTo(key) {
+			subscribed = append(subscribed, sub)
+		}
+	}
+	ch.mu.RUnlock()
+
+	// the publisher's trace is carried through to the handlers
+	headers := tracing.Inject(ctx)
+	if id := logging.CorrelationID(ctx); id != "" {
+		headers[logging.CorrelationHeader] = id
+	}
+	outcomes := make(chan error, len(subscribed))
+	delivered := 0
+	for _, sub := range subscribed {
+		ok, err := sub.deliver(ctx, channelDelivery{body: body, headers: headers, outcome: outcomes})
+		if err != nil {
+			return err
+		}
+		if ok {
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		return ErrNoSubscribers
+	}
+
+	var rejected error
+	for i := 0; i < delivered; i++ {
+		select {
+		case err := <-outcomes:
+			if err != nil {
+				rejected = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rejected
+}
+
+// PublishWhenSubscribed - as Publish, but should nothing be subscribed to the
+// routing key yet it waits for a binding to subscribe, e.g. whilst the
+// consumer is starting up
+func (ch *Channel) PublishWhenSubscribed(ctx context.Context, key string, body []byte) error {
+	for {
+		err := ch.Publish(ctx, key, body)
+		if err != ErrNoSubscribers {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(subscribeWait):
+		}
+	}
+}
+
+// channelSubscription - a binding subscribed to the in-process source
+type channelSubscription struct {
+	source     *Channel
+	binding    Binding
+	deliveries chan Delivery
+
+	// held whilst delivering, so the deliveries channel isn't closed mid send
+	mu      sync.RWMutex
+	stopped bool
+}
+
+func (sub *channelSubscription) boundTo(key string) bool {
+	for _, routingKey := range sub.binding.RoutingKeys {
+		if routingKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver - sends the delivery to the binding's workers, returning false
+// if the subscription has been stopped
+func (sub *channelSubscription) deliver(ctx context.Context, delivery Delivery) (bool, error) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+	if sub.stopped {
+		return false, nil
+	}
+	select {
+	case sub.deliveries <- delivery:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (sub *channelSubscription) Deliveries() <-chan Delivery {
+	return sub.deliveries
+}
+
+// Stop - waits for any message being delivered, then closes the deliveries
+// channel
+func (sub *channelSubscription) Stop() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.stopped {
+		sub.stopped = true
+		close(sub.deliveries)
+	}
+}
+
+func (sub *channelSubscription) Close() {
+	sub.Stop()
+	sub.source.mu.Lock()
+	delete(sub.source.subscriptions, sub)
+	sub.source.mu.Unlock()
+}
+
+// channelDelivery - a published message, its outcome is reported back to
+// the publisher
+type channelDelivery struct {
+	body    []byte
+	headers map[string]string
+	outcome chan<- error
+}
+
+func (d channelDelivery) Body() []byte {
+	return d.body
+}
+
+func (d channelDelivery) Headers() map[string]string {
+	return d.headers
+}
+
+func (d channelDelivery) Ack() error {
+	d.outcome <- nil
+	return nil
+}
+
+func (d channelDelivery) Nack() error {
+	return d.Reject(ErrRejected)
+}
+
+func (d channelDelivery) Reject(err error) error {
+	d.outcome <- err
+	return nil
+}
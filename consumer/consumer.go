@@ -0,0 +1,385 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Binding - ties a queue / routing keys to the handler for its messages. How
+// they map onto the broker depends on the source, e.g. for Kafka the queue is
+// the consumer group & the routing keys its topics
+type Binding struct {
+	Name string
+	// HandlerName is the registered name of the handler, so that a change of
+	// handler can be spotted when the bindings are updated
+	HandlerName string
+	// Exchange the queue is bound to, defaults to the source's exchange.
+	// When ExchangeType is set the exchange is declared, otherwise it must
+	// already exist
+	Exchange     string
+	ExchangeType string
+	Queue        string
+	RoutingKeys  []string
+	Durable      bool
+	AutoDelete   bool
+	Arguments    map[string]interface{}
+	Handler      func(context.Context, []byte) error
+	// Timeout for processing a single message, defaults to the consumer's
+	// handler timeout
+	Timeout time.Duration
+	// Workers is the number of messages from the queue processed concurrently
+	Workers int
+	// Prefetch is the number of unacknowledged messages the broker will send
+	// ahead of them being processed, it should be at least the number of workers
+	Prefetch int
+	// PartitionKey, when set, picks which worker processes a message. Messages
+	// with the same key are always processed by the same worker, in the order
+	// they were delivered
+	PartitionKey func([]byte) string
+}
+
+// Config - the settings for consuming from a source
+type Config struct {
+	// HandlerTimeout is how long a handler has to process a single message,
+	// unless the binding has its own timeout
+	HandlerTimeout time.Duration
+	// ReconnectDelay is the wait before the first reconnection attempt, it
+	// doubles on every failed attempt up to MaxReconnectDelay
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// Logger is logged to by the consumer, & the handlers through their
+	// contexts
+	Logger zerolog.Logger
+}
+
+// minReconnectDelay - the least the first reconnection attempt waits, as a
+// delay of 0 would never grow when doubled
+const minReconnectDelay = time.Millisecond
+
+// Status - a snapshot of the consumer's connection to the broker
+type Status struct {
+	Connected      bool      `json:"connected"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	Reconnects     int       `json:"reconnects"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// BindingStatus - a snapshot of a binding's consumption, it's active whilst
+// subscribed to the source
+type BindingStatus struct {
+	Name        string     `json:"name"`
+	Queue       string     `json:"queue"`
+	Active      bool       `json:"active"`
+	Processed   int64      `json:"processed"`
+	Failed      int64      `json:"failed"`
+	LastMessage *time.Time `json:"lastMessage,omitempty"`
+}
+
+// bindingStats - the messages a binding has processed
+type bindingStats struct {
+	processed   int64
+	failed      int64
+	lastMessage time.Time
+}
+
+// Consumer - consumes messages from a source for a set of bindings, and
+// reconnects (re-subscribing every binding) whenever the connection to the
+// broker is lost. Each binding is subscribed to separately, so they can be
+// added / removed whilst connected
+type Consumer struct {
+	config Config
+	source Source
+	errLog chan<- error
+
+	// handlerTimeout is read by the handler threads without taking the lock,
+	// which may be held whilst waiting for them
+	handlerTimeout int64
+
+	mu       sync.RWMutex
+	status   Status
+	bindings []Binding
+	// whether the source is connected, and if so the subscriptions by binding
+	// name
+	connected     bool
+	subscriptions map[string]*subscription
+	// running tracks every subscription's handler threads
+	running sync.WaitGroup
+
+	// stats are updated by the handler threads, so have their own lock
+	statsMu sync.Mutex
+	stats   map[string]*bindingStats
+}
+
+// subscription - a binding being consumed
+type subscription struct {
+	binding Binding
+	Subscription
+}
+
+// New - creates a consumer for the given bindings on the source, any errors
+// from processing messages are sent to errLog
+func New(config Config, source Source, bindings []Binding, errLog chan<- error) *Consumer {
+	if config.ReconnectDelay < minReconnectDelay {
+		config.ReconnectDelay = minReconnectDelay
+	}
+	if config.MaxReconnectDelay < config.ReconnectDelay {
+		config.MaxReconnectDelay = config.ReconnectDelay
+	}
+	return &Consumer{
+		config:         config,
+		source:         source,
+		errLog:         errLog,
+		bindings:       bindings,
+		handlerTimeout: int64(config.HandlerTimeout),
+		stats:          map[string]*bindingStats{},
+	}
+}
+
+// Source - the name of the source being consumed
+func (c *Consumer) Source() string {
+	return c.source.String()
+}
+
+// Status - returns the current state of the connection to the broker
+func (c *Consumer) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// Bindings - the state of each binding being consumed
+func (c *Consumer) Bindings() []BindingStatus {
+	c.mu.RLock()
+	statuses := make([]BindingStatus, len(c.bindings))
+	for i, binding := range c.bindings {
+		_, active := c.subscriptions[binding.Name]
+		statuses[i] = BindingStatus{Name: binding.Name, Queue: binding.Queue, Active: active}
+	}
+	c.mu.RUnlock()
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	for i := range statuses {
+		if stats, ok := c.stats[statuses[i].Name]; ok {
+			statuses[i].Processed, statuses[i].Failed = stats.processed, stats.failed
+			lastMessage := stats.lastMessage
+			statuses[i].LastMessage = &lastMessage
+		}
+	}
+	return statuses
+}
+
+// Ready - returns an error unless connected to the source & consuming every
+// binding
+func (c *Consumer) Ready() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.connected {
+		return fmt.Errorf("Not connected to %s", c.source.String())
+	}
+	var inactive []string
+	for _, binding := range c.bindings {
+		if _, ok := c.subscriptions[binding.Name]; !ok {
+			inactive = append(inactive, binding.Name)
+		}
+	}
+	if len(inactive) > 0 {
+		return fmt.Errorf("Not consuming bindings %s", strings.Join(inactive, ", "))
+	}
+	return nil
+}
+
+// recordOutcome - counts the message the binding has processed
+func (c *Consumer) recordOutcome(binding string, err error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	stats, ok := c.stats[binding]
+	if !ok {
+		stats = &bindingStats{}
+		c.stats[binding] = stats
+	}
+	stats.processed++
+	if err != nil {
+		stats.failed++
+	}
+	stats.lastMessage = time.Now()
+}
+
+// QueueLag - the messages waiting on each binding's queue, for the sources
+// able to report it
+func (c *Consumer) QueueLag() map[string]int64 {
+	c.mu.RLock()
+	subscriptions := map[string]Subscription{}
+	for name, sub := range c.subscriptions {
+		subscriptions[name] = sub.Subscription
+	}
+	c.mu.RUnlock()
+
+	// the broker's asked without holding the lock
+	lags := map[string]int64{}
+	for name, sub := range subscriptions {
+		lagger, ok := sub.(Lagger)
+		if !ok {
+			continue
+		}
+		lag, err := lagger.Lag()
+		if err != nil {
+			c.config.Logger.Warn().Err(err).Str("binding", name).Msg("Failed to look up queue lag")
+			continue
+		}
+		lags[name] = lag
+	}
+	return lags
+}
+
+// Update - replaces the bindings being consumed & the default handler
+// timeout. Bindings that have been removed or changed stop consuming, their
+// in-flight messages are still processed & acknowledged, whilst new / changed
+// bindings are subscribed to straight away. Bindings that can't be subscribed
+// to are reported, and retried when next reconnecting
+func (c *Consumer) Update(bindings []Binding, handlerTimeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bindings = bindings
+	atomic.StoreInt64(&c.handlerTimeout, int64(handlerTimeout))
+	if !c.connected {
+		// nothing more to do, they're subscribed to when connected
+		return nil
+	}
+
+	wanted := map[string]Binding{}
+	for _, binding := range bindings {
+		wanted[binding.Name] = binding
+	}
+	for name, sub := range c.subscriptions {
+		if binding, ok := wanted[name]; ok && binding.equal(sub.binding) {
+			continue
+		}
+		c.config.Logger.Info().Str("binding", name).Msg("Stopping consumer")
+		sub.Stop()
+		delete(c.subscriptions, name)
+	}
+
+	var problems []string
+	for _, binding := range bindings {
+		if _, ok := c.subscriptions[binding.Name]; ok {
+			continue
+		}
+		c.config.Logger.Info().Str("binding", binding.Name).Msg("Starting consumer")
+		if err := c.subscribe(binding); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Run - connects to the broker & consumes messages until the context is
+// cancelled. Should the connection drop it's re-established with an
+// exponential backoff
+func (c *Consumer) Run(ctx context.Context) {
+	delay := c.config.ReconnectDelay
+	for {
+		failed, err := c.source.Connect()
+		if err != nil {
+			c.config.Logger.Error().Err(err).Str("source", c.source.String()).Dur("retryIn", delay).Msg("Failed to connect")
+			c.setDisconnected(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > c.config.MaxReconnectDelay {
+				delay = c.config.MaxReconnectDelay
+			}
+			continue
+		}
+		delay = c.config.ReconnectDelay
+		c.setConnected()
+		c.config.Logger.Info().Str("source", c.source.String()).Msg("Connected")
+
+		err = c.consume(ctx, failed)
+		if ctx.Err() != nil {
+			return
+		}
+		c.config.Logger.Error().Err(err).Str("source", c.source.String()).Msg("Lost connection, reconnecting")
+		c.setDisconnected(err)
+	}
+}
+
+// consume - subscribes to every binding, then processes messages until
+// either the connection fails or the context is cancelled. Bindings that
+// can't be subscribed to are reported, & retried when next reconnecting,
+// whilst the rest are consumed
+func (c *Consumer) consume(ctx context.Context, failed <-chan error) error {
+	c.mu.Lock()
+	c.connected = true
+	c.subscriptions = map[string]*subscription{}
+	var problems []string
+	for _, binding := range c.bindings {
+		if err := c.subscribe(binding); err != nil {
+			c.config.Logger.Error().Err(err).Str("binding", binding.Name).Msg("Failed to start consumer")
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		c.status.LastError = strings.Join(problems, "; ")
+	}
+	c.mu.Unlock()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-failed:
+	}
+
+	c.mu.Lock()
+	c.connected = false
+	c.subscriptions = nil
+	c.mu.Unlock()
+
+	// closing the source closes every subscription's deliveries channel, so
+	// the handler threads can only be waited on once it's closed
+	c.source.Close()
+	c.running.Wait()
+	return err
+}
+
+func (c *Consumer) handlerTimeoutFor(binding Binding) time.Duration {
+	if binding.Timeout > 0 {
+		return binding.Timeout
+	}
+	return time.Duration(atomic.LoadInt64(&c.handlerTimeout))
+}
+
+func (c *Consumer) setConnected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.Connected = true
+	c.status.ConnectedSince = time.Now()
+	c.status.LastError = ""
+}
+
+func (c *Consumer) setDisconnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status.Connected {
+		c.status.Reconnects++
+	}
+	c.status.Connected = false
+	c.status.ConnectedSince = time.Time{}
+	if err != nil {
+		c.status.LastError = err.Error()
+	}
+}
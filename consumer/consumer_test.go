@@ -0,0 +1,226 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout - how long a test waits on the pipeline before failing
+const testTimeout = 5 * time.Second
+
+// failingSource - an in-process source that can't subscribe to some bindings
+type failingSource struct {
+	*Channel
+	failing map[string]bool
+}
+
+func (s *failingSource) Subscribe(binding Binding) (Subscription, error) {
+	if s.failing[binding.Name] {
+		return nil, errors.New("Can't subscribe to " + binding.Name)
+	}
+	return s.Channel.Subscribe(binding)
+}
+
+// recorder - a handler recording the messages it's given
+type recorder struct {
+	mu       sync.Mutex
+	messages []string
+	err      error
+}
+
+func (r *recorder) handle(ctx context.Context, msg []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, string(msg))
+	return r.err
+}
+
+func (r *recorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+// run - runs the consumer until the test ends
+func run(t *testing.T, c *Consumer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func publish(t *testing.T, source *Channel, key, body string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	return source.PublishWhenSubscribed(ctx, key, []byte(body))
+}
+
+func TestPipelineHandlesPublishedMessages(t *testing.T) {
+	source := NewChannel()
+	handler := &recorder{}
+	c := New(Config{HandlerTimeout: time.Second}, source, []Binding{
+		{Name: "folderWatch", RoutingKeys: []string{"watch"}, Handler: handler.handle, Workers: 2},
+	}, make(chan error, 10))
+	run(t, c)
+
+	for _, body := range []string{"one", "two"} {
+		if err := publish(t, source, "watch", body); err != nil {
+			t.Fatalf("Publishing %s failed %v", body, err)
+		}
+	}
+	if got := handler.received(); strings.Join(got, ",") != "one,two" {
+		t.Errorf("Handled %v, want [one two]", got)
+	}
+	statuses := c.Bindings()
+	if len(statuses) != 1 || !statuses[0].Active || statuses[0].Processed != 2 || statuses[0].Failed != 0 {
+		t.Errorf("Binding status %+v, want active with 2 processed", statuses)
+	}
+	if err := c.Ready(); err != nil {
+		t.Errorf("Not ready %v", err)
+	}
+}
+
+func TestPipelineRejectsFailedMessages(t *testing.T) {
+	source := NewChannel()
+	failure := errors.New("Can't index")
+	handler := &recorder{err: failure}
+	errLog := make(chan error, 10)
+	c := New(Config{HandlerTimeout: time.Second}, source, []Binding{
+		{Name: "folderWatch", RoutingKeys: []string{"watch"}, Handler: handler.handle},
+	}, errLog)
+	run(t, c)
+
+	if err := publish(t, source, "watch", "one"); err != failure {
+		t.Fatalf("Publishing gave %v, want the handler's error", err)
+	}
+	select {
+	case err := <-errLog:
+		if err != failure {
+			t.Errorf("Logged %v, want the handler's error", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("The handler's error wasn't logged")
+	}
+	if statuses := c.Bindings(); statuses[0].Failed != 1 {
+		t.Errorf("Binding status %+v, want 1 failed", statuses[0])
+	}
+}
+
+func TestPipelineTimesOutHandlers(t *testing.T) {
+	source := NewChannel()
+	c := New(Config{HandlerTimeout: 10 * time.Millisecond}, source, []Binding{
+		{Name: "slow", RoutingKeys: []string{"slow"}, Handler: func(ctx context.Context, msg []byte) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}, make(chan error, 10))
+	run(t, c)
+
+	if err := publish(t, source, "slow", "one"); err != context.DeadlineExceeded {
+		t.Errorf("Publishing gave %v, want the handler to time out", err)
+	}
+}
+
+func TestPipelineKeepsPartitionOrder(t *testing.T) {
+	source := NewChannel()
+	handler := &recorder{}
+	c := New(Config{HandlerTimeout: time.Second}, source, []Binding{
+		{
+			Name:         "folderWatch",
+			RoutingKeys:  []string{"watch"},
+			Handler:      handler.handle,
+			Workers:      4,
+			PartitionKey: func(msg []byte) string { return string(msg[:1]) },
+		},
+	}, make(chan error, 10))
+	run(t, c)
+
+	// published concurrently per key, each key's messages in order
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if err := publish(t, source, "watch", key+string(rune('0'+i))); err != nil {
+					t.Errorf("Publishing failed %v", err)
+				}
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	last := map[byte]byte{}
+	for _, msg := range handler.received() {
+		if previous, ok := last[msg[0]]; ok && msg[1] <= previous {
+			t.Errorf("%s was handled out of order", msg)
+		}
+		last[msg[0]] = msg[1]
+	}
+	if got := len(handler.received()); got != 15 {
+		t.Errorf("Handled %d messages, want 15", got)
+	}
+}
+
+func TestConsumeCarriesOnPastBindingsThatFail(t *testing.T) {
+	source := &failingSource{Channel: NewChannel(), failing: map[string]bool{"bad": true}}
+	handler := &recorder{}
+	c := New(Config{HandlerTimeout: time.Second}, source, []Binding{
+		{Name: "bad", RoutingKeys: []string{"bad"}, Handler: handler.handle},
+		{Name: "good", RoutingKeys: []string{"good"}, Handler: handler.handle},
+	}, make(chan error, 10))
+	run(t, c)
+
+	if err := publish(t, source.Channel, "good", "one"); err != nil {
+		t.Fatalf("Publishing to the good binding failed %v", err)
+	}
+	if err := c.Ready(); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Ready gave %v, want the bad binding reported", err)
+	}
+	if status := c.Status(); !status.Connected || !strings.Contains(status.LastError, "Can't subscribe to bad") {
+		t.Errorf("Status %+v, want connected with the bad binding's error", status)
+	}
+}
+
+func TestUpdateChangesTheBindingsConsumed(t *testing.T) {
+	source := NewChannel()
+	handler := &recorder{}
+	c := New(Config{HandlerTimeout: time.Second}, source, []Binding{
+		{Name: "old", RoutingKeys: []string{"old"}, Handler: handler.handle},
+	}, make(chan error, 10))
+	run(t, c)
+	if err := publish(t, source, "old", "one"); err != nil {
+		t.Fatalf("Publishing failed %v", err)
+	}
+
+	err := c.Update([]Binding{
+		{Name: "new", RoutingKeys: []string{"new"}, Handler: handler.handle},
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Update failed %v", err)
+	}
+	if err := publish(t, source, "new", "two"); err != nil {
+		t.Errorf("Publishing to the added binding failed %v", err)
+	}
+	if err := source.Publish(context.Background(), "old", []byte("three")); err != ErrNoSubscribers {
+		t.Errorf("Publishing to the removed binding gave %v, want ErrNoSubscribers", err)
+	}
+}
+
+func TestNewBacksOffFromAtLeastAMillisecond(t *testing.T) {
+	c := New(Config{}, NewChannel(), nil, nil)
+	if c.config.ReconnectDelay != minReconnectDelay || c.config.MaxReconnectDelay != minReconnectDelay {
+		t.Errorf("Reconnect delay %v up to %v, want %v", c.config.ReconnectDelay, c.config.MaxReconnectDelay, minReconnectDelay)
+	}
+}
@@ -0,0 +1,309 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaLagTimeout - how long looking up a consumer group's lag may take
+const kafkaLagTimeout = 5 * time.Second
+
+// Kafka - a source consuming from Kafka. A binding's queue is its consumer
+// group, and its routing keys the topics it reads
+type Kafka struct {
+	Brokers []string
+	// Logger is logged to with problems the consumer isn't told of
+	Logger zerolog.Logger
+
+	mu            sync.Mutex
+	subscriptions map[*kafkaSubscription]bool
+	failed        chan error
+}
+
+func (k *Kafka) String() string {
+	return "Kafka"
+}
+
+// Connect - checks a broker can be reached, the readers connect (and
+// reconnect) to the cluster themselves
+func (k *Kafka) Connect() (<-chan error, error) {
+	if err := k.dialBroker(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.subscriptions = map[*kafkaSubscription]bool{}
+	k.failed = make(chan error, 1)
+	return k.failed, nil
+}
+
+// dialBroker - succeeds as soon as any of the brokers can be connected to
+func (k *Kafka) dialBroker() error {
+	var problems []string
+	for _, broker := range k.Brokers {
+		conn, err := kafka.Dial("tcp", broker)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		return conn.Close()
+	}
+	return fmt.Errorf("Failed to connect to a Kafka broker %s", strings.Join(problems, "; "))
+}
+
+// Close - stops every subscription, closing their deliveries channels
+func (k *Kafka) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for sub := range k.subscriptions {
+		sub.Stop()
+	}
+	k.subscriptions = nil
+	return nil
+}
+
+// Subscribe - starts reading the binding's topics as its consumer group
+func (k *Kafka) Subscribe(binding Binding) (Subscription, error) {
+	if len(binding.RoutingKeys) == 0 {
+		return nil, fmt.Errorf("No topics to read for %s", binding.Name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:       k.Brokers,
+		GroupID:       binding.Queue,
+		GroupTopics:   binding.RoutingKeys,
+		QueueCapacity: binding.Prefetch,
+	})
+	sub := &kafkaSubscription{
+		source:     k,
+		binding:    binding,
+		reader:     reader,
+		committer:  newKafkaCommitter(reader),
+		deliveries: make(chan Delivery),
+		cancel:     cancel,
+	}
+
+	k.mu.Lock()
+	k.subscriptions[sub] = true
+	failed := k.failed
+	k.mu.Unlock()
+
+	go sub.fetch(ctx, failed)
+	return sub, nil
+}
+
+// kafkaSubscription - a binding's consumer group reader
+type kafkaSubscription struct {
+	source     *Kafka
+	binding    Binding
+	reader     *kafka.Reader
+	committer  *kafkaCommitter
+	deliveries chan Delivery
+	cancel     context.CancelFunc
+}
+
+func (sub *kafkaSubscription) Deliveries() <-chan Delivery {
+	return sub.deliveries
+}
+
+// Lag - how far the consumer group's committed offsets are behind the end
+// of its topics' partitions. The reader's own stats can't say for a group,
+// as it only knows of the partitions it's been assigned
+func (sub *kafkaSubscription) Lag() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaLagTimeout)
+	defer cancel()
+	client := &kafka.Client{Addr: kafka.TCP(sub.source.Brokers...)}
+
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: sub.binding.RoutingKeys})
+	if err != nil {
+		return 0, err
+	}
+	partitions := map[string][]int{}
+	offsets := map[string][]kafka.OffsetRequest{}
+	for _, topic := range metadata.Topics {
+		if topic.Error != nil {
+			return 0, topic.Error
+		}
+		for _, partition := range topic.Partitions {
+			partitions[topic.Name] = append(partitions[topic.Name], partition.ID)
+			offsets[topic.Name] = append(offsets[topic.Name], kafka.FirstOffsetOf(partition.ID), kafka.LastOffsetOf(partition.ID))
+		}
+	}
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: sub.binding.Queue, Topics: partitions})
+	if err != nil {
+		return 0, err
+	}
+	if committed.Error != nil {
+		return 0, committed.Error
+	}
+	listed, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: offsets})
+	if err != nil {
+		return 0, err
+	}
+
+	var lag int64
+	for topic, partitionOffsets := range listed.Topics {
+		next := map[int]int64{}
+		for _, partition := range committed.Topics[topic] {
+			if partition.Error != nil {
+				return 0, partition.Error
+			}
+			next[partition.Partition] = partition.CommittedOffset
+		}
+		for _, partition := range partitionOffsets {
+			if partition.Error != nil {
+				return 0, partition.Error
+			}
+			// without a committed offset the group starts from the first
+			start, ok := next[partition.Partition]
+			if !ok || start < partition.FirstOffset {
+				start = partition.FirstOffset
+			}
+			if partition.LastOffset > start {
+				lag += partition.LastOffset - start
+			}
+		}
+	}
+	return lag, nil
+}
+
+// Stop - stops fetching messages
+func (sub *kafkaSubscription) Stop() {
+	sub.cancel()
+}
+
+// Close - leaves the consumer group, anything fetched but not committed is
+// read again by whichever member is assigned its partition
+func (sub *kafkaSubscription) Close() {
+	sub.cancel()
+	sub.source.mu.Lock()
+	delete(sub.source.subscriptions, sub)
+	sub.source.mu.Unlock()
+	if err := sub.reader.Close(); err != nil {
+		sub.source.Logger.Error().Err(err).Str("binding", sub.binding.Name).Msg("Problem closing Kafka reader")
+	}
+}
+
+// fetch - reads messages until stopped
+func (sub *kafkaSubscription) fetch(ctx context.Context, failed chan<- error) {
+	defer close(sub.deliveries)
+	for {
+		msg, err := sub.reader.FetchMessage(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				sub.source.Logger.Error().Err(err).Str("binding", sub.binding.Name).Msg("Problem fetching from Kafka")
+				sendFailed(failed, err)
+			}
+			return
+		}
+		sub.committer.fetched(msg)
+		sub.deliveries <- kafkaDelivery{committer: sub.committer, msg: msg}
+	}
+}
+
+type kafkaDelivery struct {
+	committer *kafkaCommitter
+	msg       kafka.Message
+}
+
+func (d kafkaDelivery) Body() []byte {
+	return d.msg.Value
+}
+
+func (d kafkaDelivery) Headers() map[string]string {
+	headers := map[string]string{}
+	for _, header := range d.msg.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	return headers
+}
+
+func (d kafkaDelivery) Ack() error {
+	return d.committer.done(d.msg)
+}
+
+// Nack - Kafka can't reject a single message, so it's committed so as not to
+// be read again. The handler's error has already been reported
+func (d kafkaDelivery) Nack() error {
+	return d.committer.done(d.msg)
+}
+
+// kafkaPartition - a topic's partition
+type kafkaPartition struct {
+	topic string
+	id    int
+}
+
+// kafkaCommitter - commits the messages a reader fetched, in the order they
+// were fetched from each partition. Committing a message's offset commits
+// every message before it in the partition too, so with several workers a
+// message is only committed once every one fetched before it is done, else
+// a crash would lose those still being processed
+type kafkaCommitter struct {
+	reader kafkaCommitReader
+
+	mu sync.Mutex
+	// pending are the offsets fetched from each partition but not yet
+	// committed, in order, & finished the messages done with amongst them
+	pending  map[kafkaPartition][]int64
+	finished map[kafkaPartition]map[int64]kafka.Message
+}
+
+// kafkaCommitReader - the reader messages are committed to
+type kafkaCommitReader interface {
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+func newKafkaCommitter(reader kafkaCommitReader) *kafkaCommitter {
+	return &kafkaCommitter{
+		reader:   reader,
+		pending:  map[kafkaPartition][]int64{},
+		finished: map[kafkaPartition]map[int64]kafka.Message{},
+	}
+}
+
+// fetched - the message has been fetched, in partition order
+func (c *kafkaCommitter) fetched(msg kafka.Message) {
+	partition := kafkaPartition{msg.Topic, msg.Partition}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[partition] = append(c.pending[partition], msg.Offset)
+}
+
+// done - the message is finished with, commits it along with any after it
+// that were waiting on it. The lock's held whilst committing, so a later
+// offset can't be overtaken by an earlier one
+func (c *kafkaCommitter) done(msg kafka.Message) error {
+	partition := kafkaPartition{msg.Topic, msg.Partition}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished[partition] == nil {
+		c.finished[partition] = map[int64]kafka.Message{}
+	}
+	c.finished[partition][msg.Offset] = msg
+
+	var commit *kafka.Message
+	pending := c.pending[partition]
+	for len(pending) > 0 {
+		finished, ok := c.finished[partition][pending[0]]
+		if !ok {
+			break
+		}
+		delete(c.finished[partition], pending[0])
+		commit = &finished
+		pending = pending[1:]
+	}
+	c.pending[partition] = pending
+	if commit == nil {
+		return nil
+	}
+	return c.reader.CommitMessages(context.Background(), *commit)
+}
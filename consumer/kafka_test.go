@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// commitRecorder - records the offsets committed to it
+type commitRecorder struct {
+	committed []kafka.Message
+}
+
+func (r *commitRecorder) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *commitRecorder) offsets() []int64 {
+	var offsets []int64
+	for _, msg := range r.committed {
+		offsets = append(offsets, msg.Offset)
+	}
+	return offsets
+}
+
+func TestKafkaCommitterCommitsInPartitionOrder(t *testing.T) {
+	reader := &commitRecorder{}
+	committer := newKafkaCommitter(reader)
+	msgs := make([]kafka.Message, 4)
+	for i := range msgs {
+		msgs[i] = kafka.Message{Topic: "watch", Partition: 0, Offset: int64(10 + i)}
+		committer.fetched(msgs[i])
+	}
+
+	// finishing out of order holds the later offsets back
+	for _, i := range []int{2, 1} {
+		if err := committer.done(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reader.committed) != 0 {
+		t.Fatalf("Committed %v before offset 10 was done", reader.offsets())
+	}
+	committer.done(msgs[0])
+	committer.done(msgs[3])
+	if got := reader.offsets(); len(got) != 2 || got[0] != 12 || got[1] != 13 {
+		t.Errorf("Committed %v, want [12 13]", got)
+	}
+}
+
+func TestKafkaCommitterKeepsPartitionsApart(t *testing.T) {
+	reader := &commitRecorder{}
+	committer := newKafkaCommitter(reader)
+	first := kafka.Message{Topic: "watch", Partition: 0, Offset: 5}
+	second := kafka.Message{Topic: "watch", Partition: 1, Offset: 7}
+	committer.fetched(first)
+	committer.fetched(second)
+
+	committer.done(second)
+	if len(reader.committed) != 1 || reader.committed[0].Partition != 1 {
+		t.Errorf("Committed %v, want partition 1 without waiting on partition 0", reader.committed)
+	}
+}
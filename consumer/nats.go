@@ -0,0 +1,238 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// fetchWait - how long a pull waits for messages before checking whether
+// the subscription has been stopped
+const fetchWait = time.Second
+
+// NATS - a source consuming from NATS JetStream. Each of a binding's routing
+// keys is a subject, consumed by a durable pull consumer on the binding's
+// exchange (the stream), named after the binding's queue & the subject
+type NATS struct {
+	URL      string
+	User     string
+	Password string
+	Token    string
+	// Stream bindings consume from unless they give their own exchange
+	Stream string
+	// Logger is logged to with problems the consumer isn't told of
+	Logger zerolog.Logger
+
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	failed chan error
+}
+
+func (n *NATS) String() string {
+	return "NATS"
+}
+
+// Connect - connects to the NATS server. The client reconnects itself after
+// brief outages, the connection's only reported as failed once it gives up
+func (n *NATS) Connect() (<-chan error, error) {
+	failed := make(chan error, 1)
+	options := []nats.Option{
+		nats.ClosedHandler(func(*nats.Conn) {
+			sendFailed(failed, errors.New("NATS connection closed"))
+		}),
+	}
+	if n.User != "" {
+		options = append(options, nats.UserInfo(n.User, n.Password))
+	}
+	if n.Token != "" {
+		options = append(options, nats.Token(n.Token))
+	}
+
+	conn, err := nats.Connect(n.URL, options...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to enable NATS JetStream %v", err)
+	}
+
+	n.conn = conn
+	n.js = js
+	n.failed = failed
+	return failed, nil
+}
+
+// Close - closing the connection ends every pull, and so closes every
+// deliveries channel
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
+
+// Subscribe - ensures a durable consumer exists for each of the binding's
+// subjects, and starts pulling messages from them
+func (n *NATS) Subscribe(binding Binding) (Subscription, error) {
+	stream := binding.exchange(n.Stream)
+	sub := &natsSubscription{
+		binding:    binding,
+		logger:     n.Logger,
+		deliveries: make(chan Delivery),
+		stop:       make(chan struct{}),
+	}
+
+	for _, subject := range binding.RoutingKeys {
+		durable := durableName(binding.Queue, subject)
+		if err := n.ensureConsumer(stream, durable, subject, binding.Prefetch); err != nil {
+			sub.Close()
+			return nil, fmt.Errorf("Problem creating consumer %s on stream %s for %s %v", durable, stream, binding.Name, err)
+		}
+		// bound to the consumer, so it isn't deleted when unsubscribing
+		pull, err := n.js.PullSubscribe(subject, durable, nats.Bind(stream, durable))
+		if err != nil {
+			sub.Close()
+			return nil, fmt.Errorf("Problem subscribing to %s for %s %v", subject, binding.Name, err)
+		}
+		sub.pulls = append(sub.pulls, pull)
+	}
+
+	var wg sync.WaitGroup
+	for _, pull := range sub.pulls {
+		wg.Add(1)
+		go func(pull *nats.Subscription) {
+			defer wg.Done()
+			sub.fetch(pull, n.failed)
+		}(pull)
+	}
+	go func() {
+		wg.Wait()
+		close(sub.deliveries)
+	}()
+	return sub, nil
+}
+
+// ensureConsumer - creates the durable consumer, unless it already exists
+func (n *NATS) ensureConsumer(stream, durable, subject string, prefetch int) error {
+	_, err := n.js.ConsumerInfo(stream, durable)
+	if err == nil || !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+	_, err = n.js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       durable,
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: subject,
+		MaxAckPending: prefetch,
+	})
+	return err
+}
+
+// durableName - consumer names can't contain the subject's separators or
+// wildcards
+func durableName(queue, subject string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(queue + "_" + subject)
+}
+
+// natsSubscription - a binding's pull consumers
+type natsSubscription struct {
+	binding    Binding
+	logger     zerolog.Logger
+	pulls      []*nats.Subscription
+	deliveries chan Delivery
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+func (sub *natsSubscription) Deliveries() <-chan Delivery {
+	return sub.deliveries
+}
+
+// Lag - the messages pending across the binding's consumers
+func (sub *natsSubscription) Lag() (int64, error) {
+	var lag int64
+	for _, pull := range sub.pulls {
+		info, err := pull.ConsumerInfo()
+		if err != nil {
+			return 0, err
+		}
+		lag += int64(info.NumPending)
+	}
+	return lag, nil
+}
+
+// Stop - ends the pulls, once the messages already fetched have been read
+func (sub *natsSubscription) Stop() {
+	sub.stopOnce.Do(func() {
+		close(sub.stop)
+	})
+}
+
+// Close - anything fetched but not acknowledged is redelivered by the server
+// once its ack wait expires
+func (sub *natsSubscription) Close() {
+	sub.Stop()
+	for _, pull := range sub.pulls {
+		pull.Unsubscribe()
+	}
+}
+
+// fetch - pulls messages for one subject until stopped or the connection is
+// closed
+func (sub *natsSubscription) fetch(pull *nats.Subscription, failed chan<- error) {
+	batch := sub.binding.Prefetch
+	if batch < 1 {
+		batch = 1
+	}
+	for {
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+
+		msgs, err := pull.Fetch(batch, nats.MaxWait(fetchWait))
+		switch {
+		case errors.Is(err, nats.ErrTimeout):
+			continue
+		case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrBadSubscription):
+			return
+		case err != nil:
+			sub.logger.Error().Err(err).Str("binding", sub.binding.Name).Msg("Problem fetching from NATS")
+			sendFailed(failed, err)
+			return
+		}
+		for _, msg := range msgs {
+			sub.deliveries <- natsDelivery{msg}
+		}
+	}
+}
+
+type natsDelivery struct {
+	msg *nats.Msg
+}
+
+func (d natsDelivery) Body() []byte {
+	return d.msg.Data
+}
+
+func (d natsDelivery) Headers() map[string]string {
+	headers := map[string]string{}
+	for key := range d.msg.Header {
+		headers[key] = d.msg.Header.Get(key)
+	}
+	return headers
+}
+
+func (d natsDelivery) Ack() error {
+	return d.msg.Ack()
+}
+
+// Nack - terminates the message, so that it isn't redelivered
+func (d natsDelivery) Nack() error {
+	return d.msg.Term()
+}
@@ -0,0 +1,159 @@
+package consumer
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("consumer")
+
+// subscribe - subscribes to the binding on the source & starts a thread
+// handling its messages. Must be called holding the lock, whilst connected
+func (c *Consumer) subscribe(binding Binding) error {
+	sub, err := c.source.Subscribe(binding)
+	if err != nil {
+		return err
+	}
+
+	c.subscriptions[binding.Name] = &subscription{binding: binding, Subscription: sub}
+	metrics.Prefetch.WithLabelValues(binding.Name).Set(float64(binding.Prefetch))
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		c.handleDeliveries(binding, sub.Deliveries())
+		sub.Close()
+	}()
+	return nil
+}
+
+// handleDeliveries - shares the deliveries out between the binding's workers,
+// until the deliveries channel is closed. Without a partition key the workers
+// all take from the one queue, otherwise each has its own
+func (c *Consumer) handleDeliveries(binding Binding, deliveries <-chan Delivery) {
+	workers := make([]chan Delivery, binding.workers())
+	shared := make(chan Delivery)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = shared
+		if binding.PartitionKey != nil {
+			workers[i] = make(chan Delivery)
+		}
+		wg.Add(1)
+		go func(work <-chan Delivery) {
+			defer wg.Done()
+			for delivery := range work {
+				c.handleDelivery(binding, delivery)
+			}
+		}(workers[i])
+	}
+
+	// listen for messages being delivered
+	inFlight := metrics.InFlight.WithLabelValues(binding.Name)
+	for delivery := range deliveries {
+		inFlight.Inc()
+		workers[binding.partition(delivery.Body(), len(workers))] <- delivery
+	}
+
+	if binding.PartitionKey == nil {
+		close(shared)
+	} else {
+		for _, work := range workers {
+			close(work)
+		}
+	}
+	wg.Wait()
+}
+
+// handleDelivery - passes the delivery to the binding's handler, and
+// acknowledges it depending on the outcome
+func (c *Consumer) handleDelivery(binding Binding, delivery Delivery) {
+	defer metrics.InFlight.WithLabelValues(binding.Name).Dec()
+
+	// continue the trace the message was published in, if it carries one, &
+	// log under its correlation ID, or a new one if it doesn't have one
+	ctx := logging.WithLogger(context.Background(), c.config.Logger)
+	var headers map[string]string
+	if headered, ok := delivery.(Headered); ok {
+		headers = headered.Headers()
+		ctx = tracing.Extract(ctx, headers)
+	}
+	ctx = logging.WithCorrelationID(ctx, headers[logging.CorrelationHeader])
+	ctx = logging.WithLogger(ctx, logging.Ctx(ctx).With().Str("binding", binding.Name).Logger())
+	logging.Ctx(ctx).Debug().Msg("Reading message")
+	ctx, span := tracer.Start(ctx, binding.Name+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", c.source.String()),
+			attribute.String("messaging.destination.name", binding.Queue),
+			attribute.String("messaging.binding", binding.Name),
+		))
+
+	ctx, cancel := context.WithTimeout(ctx, c.handlerTimeoutFor(binding))
+	started := time.Now()
+	err := binding.Handler(ctx, delivery.Body())
+	metrics.HandlerDuration.WithLabelValues(binding.Name).Observe(time.Since(started).Seconds())
+	// release resources if the handler completes before timeout elapses
+	cancel()
+	tracing.End(span, err)
+	c.recordOutcome(binding.Name, err)
+	if err != nil {
+		logging.Ctx(ctx).Warn().Err(err).Msg("Failed to process message")
+		metrics.Deliveries.WithLabelValues(binding.Name, "nack").Inc()
+		// there has been an error processing the message, add to the error log
+		c.errLog <- err
+		// and negatively acknowledge message processing
+		nack := delivery.Nack
+		if rejecter, ok := delivery.(Rejecter); ok {
+			nack = func() error { return rejecter.Reject(err) }
+		}
+		if err := nack(); err != nil {
+			c.errLog <- err
+		}
+		return
+	}
+	// successfully processed message - acknowledge
+	metrics.Deliveries.WithLabelValues(binding.Name, "ack").Inc()
+	if err := delivery.Ack(); err != nil {
+		c.errLog <- err
+	}
+}
+
+func (b Binding) exchange(defaultExchange string) string {
+	if b.Exchange == "" {
+		return defaultExchange
+	}
+	return b.Exchange
+}
+
+func (b Binding) workers() int {
+	if b.Workers < 1 {
+		return 1
+	}
+	return b.Workers
+}
+
+// partition - returns the index of the worker that should process the message
+func (b Binding) partition(msg []byte, workers int) int {
+	if workers == 1 || b.PartitionKey == nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(b.PartitionKey(msg)))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// equal - whether two bindings are declared & consumed the same way
+func (b Binding) equal(other Binding) bool {
+	b.Handler, other.Handler = nil, nil
+	b.PartitionKey, other.PartitionKey = nil, nil
+	return reflect.DeepEqual(b, other)
+}
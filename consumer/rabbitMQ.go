@@ -0,0 +1,205 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/rs/zerolog"
+	"github.com/streadway/amqp"
+)
+
+// RabbitMQ - a source consuming from RabbitMQ queues, each binding on its own
+// channel
+type RabbitMQ struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	// Exchange is declared when connecting, and is the exchange bindings use
+	// unless they give their own
+	Exchange string
+	// Logger is logged to with problems the consumer isn't told of
+	Logger zerolog.Logger
+
+	client *rabbitMQ.MessageClient
+	failed chan error
+}
+
+var consumerTagSequence uint64
+
+func (r *RabbitMQ) String() string {
+	return "RabbitMQ"
+}
+
+// Connect - opens the connection, channel & exchange on the broker
+func (r *RabbitMQ) Connect() (<-chan error, error) {
+	client := &rabbitMQ.MessageClient{}
+	if err := client.Connect(&r.Host, &r.Port, &r.User, &r.Password); err != nil {
+		return nil, err
+	}
+	if err := client.ConfigureChannelAndExchange(&r.Exchange); err != nil {
+		client.Connection.Close()
+		return nil, fmt.Errorf("Failed to configure RabbitMQ Channel / Exchange %v", err)
+	}
+
+	failed := make(chan error, 1)
+	notify := client.Connection.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if amqpErr := <-notify; amqpErr != nil {
+			sendFailed(failed, amqpErr)
+			return
+		}
+		sendFailed(failed, errors.New("RabbitMQ connection closed"))
+	}()
+
+	r.client = client
+	r.failed = failed
+	return failed, nil
+}
+
+// Close - closing the connection closes every channel & so every deliveries
+// channel
+func (r *RabbitMQ) Close() error {
+	return r.client.Connection.Close()
+}
+
+// Subscribe - opens a channel for the binding, declares & binds its queue and
+// starts consuming
+func (r *RabbitMQ) Subscribe(binding Binding) (Subscription, error) {
+	channel, err := r.client.Connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Problem opening channel for %s %v", binding.Name, err)
+	}
+
+	sub := &rabbitMQSubscription{
+		binding: binding,
+		logger:  r.Logger,
+		channel: channel,
+		tag:     fmt.Sprintf("%s-%d", binding.Name, atomic.AddUint64(&consumerTagSequence, 1)),
+	}
+	deliveries, err := r.declare(sub)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	// the channel failing (rather than being closed by Close) means the
+	// connection needs to be re-established
+	failed := r.failed
+	notify := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if amqpErr := <-notify; amqpErr != nil {
+			sendFailed(failed, amqpErr)
+		}
+	}()
+
+	sub.deliveries = make(chan Delivery)
+	go func() {
+		for delivery := range deliveries {
+			sub.deliveries <- rabbitMQDelivery{delivery}
+		}
+		close(sub.deliveries)
+	}()
+	return sub, nil
+}
+
+// declare - declares the exchange (if needed) & queue, binds it to the
+// exchange & starts consuming
+func (r *RabbitMQ) declare(sub *rabbitMQSubscription) (<-chan amqp.Delivery, error) {
+	binding, channel := sub.binding, sub.channel
+	exchange := binding.exchange(r.Exchange)
+	if binding.ExchangeType != "" {
+		if err := channel.ExchangeDeclare(exchange, binding.ExchangeType, binding.Durable, false, false, false, nil); err != nil {
+			return nil, fmt.Errorf("Problem declaring exchange %s for %s %v", exchange, binding.Name, err)
+		}
+	} else if err := channel.ExchangeDeclarePassive(exchange, "", false, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("Exchange %s for %s doesn't exist %v", exchange, binding.Name, err)
+	}
+	if _, err := channel.QueueDeclare(binding.Queue, binding.Durable, binding.AutoDelete, false, false, amqp.Table(binding.Arguments)); err != nil {
+		return nil, fmt.Errorf("Problem declaring queue %s %v", binding.Queue, err)
+	}
+	for _, key := range binding.RoutingKeys {
+		if err := channel.QueueBind(binding.Queue, key, exchange, false, nil); err != nil {
+			return nil, fmt.Errorf("Problem binding queue %s to %s with key %s %v", binding.Queue, exchange, key, err)
+		}
+	}
+	if err := channel.Qos(binding.Prefetch, 0, false); err != nil {
+		return nil, fmt.Errorf("Problem setting QOS for queue %s %v", binding.Queue, err)
+	}
+	deliveries, err := channel.Consume(binding.Queue, sub.tag, false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Problem setting consumer for queue %s %v", binding.Queue, err)
+	}
+	return deliveries, nil
+}
+
+// rabbitMQSubscription - a binding being consumed on its own channel
+type rabbitMQSubscription struct {
+	binding    Binding
+	logger     zerolog.Logger
+	channel    *amqp.Channel
+	tag        string
+	deliveries chan Delivery
+}
+
+func (sub *rabbitMQSubscription) Deliveries() <-chan Delivery {
+	return sub.deliveries
+}
+
+// Lag - the messages ready on the queue
+func (sub *rabbitMQSubscription) Lag() (int64, error) {
+	queue, err := sub.channel.QueueInspect(sub.binding.Queue)
+	if err != nil {
+		return 0, err
+	}
+	return int64(queue.Messages), nil
+}
+
+// Stop - asks the broker to stop delivering to the subscription, which closes
+// its deliveries channel once the messages already delivered are read
+func (sub *rabbitMQSubscription) Stop() {
+	if err := sub.channel.Cancel(sub.tag, false); err != nil {
+		sub.logger.Error().Err(err).Str("binding", sub.binding.Name).Msg("Problem cancelling consumer")
+		sub.channel.Close()
+	}
+}
+
+// Close - anything the broker sent ahead that wasn't processed is returned to
+// the queue when the channel closes
+func (sub *rabbitMQSubscription) Close() {
+	sub.channel.Close()
+}
+
+type rabbitMQDelivery struct {
+	delivery amqp.Delivery
+}
+
+func (d rabbitMQDelivery) Body() []byte {
+	return d.delivery.Body
+}
+
+// Headers - the message's string headers, along with its correlation ID
+// should the publisher have set the property rather than the header
+func (d rabbitMQDelivery) Headers() map[string]string {
+	headers := map[string]string{}
+	for key, value := range d.delivery.Headers {
+		if str, ok := value.(string); ok {
+			headers[key] = str
+		}
+	}
+	if _, ok := headers[logging.CorrelationHeader]; !ok && d.delivery.CorrelationId != "" {
+		headers[logging.CorrelationHeader] = d.delivery.CorrelationId
+	}
+	return headers
+}
+
+func (d rabbitMQDelivery) Ack() error {
+	return d.delivery.Ack(false)
+}
+
+func (d rabbitMQDelivery) Nack() error {
+	return d.delivery.Nack(false, false)
+}
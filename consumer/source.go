@@ -0,0 +1,63 @@
+package consumer
+
+// Source - a message broker the consumer receives messages from
+type Source interface {
+	// Connect - connects to the broker. The returned channel receives an error
+	// should the connection (or a subscription) fail & need re-establishing
+	Connect() (<-chan error, error)
+	// Subscribe - starts delivering the binding's messages, only called
+	// whilst connected
+	Subscribe(binding Binding) (Subscription, error)
+	// Close - disconnects from the broker, which closes the deliveries channel
+	// of every subscription
+	Close() error
+	// String - the name of the source for logging
+	String() string
+}
+
+// Subscription - the messages being delivered for a binding
+type Subscription interface {
+	// Deliveries - the channel messages are delivered on, closed once the
+	// subscription has been stopped or the source closed
+	Deliveries() <-chan Delivery
+	// Stop - stops any more messages being delivered
+	Stop()
+	// Close - releases the subscription, once every delivery has been handled
+	Close()
+}
+
+// Delivery - a message which must be acknowledged once it's been handled
+type Delivery interface {
+	Body() []byte
+	// Ack - the message has been processed successfully
+	Ack() error
+	// Nack - the message couldn't be processed, & mustn't be redelivered
+	Nack() error
+}
+
+// Headered - implemented by deliveries carrying headers, from which the
+// trace context is extracted
+type Headered interface {
+	Headers() map[string]string
+}
+
+// Lagger - implemented by subscriptions that can report how many messages
+// are waiting on the broker to be delivered
+type Lagger interface {
+	Lag() (int64, error)
+}
+
+// Rejecter - implemented by deliveries that can be told why they've been
+// rejected, in place of Nack
+type Rejecter interface {
+	Reject(err error) error
+}
+
+// sendFailed - reports the connection has failed, only the first failure
+// matters as it causes a reconnect
+func sendFailed(failed chan<- error, err error) {
+	select {
+	case failed <- err:
+	default:
+	}
+}
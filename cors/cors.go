@@ -0,0 +1,181 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Options - the cross origin requests that are allowed
+type Options struct {
+	// AllowedOrigins may be * for any origin, or contain a single * wildcard,
+	// e.g. https://*.example.com
+	AllowedOrigins []string
+	AllowedMethods []string
+	// AllowedHeaders are the request headers callers may send, * allowing any
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers callers may read
+	ExposedHeaders []string
+	// AllowCredentials lets cookies, authorization headers & client
+	// certificates be sent. The caller's origin is always echoed back with
+	// it, rather than *, & the origins must be listed, see Validate
+	AllowCredentials bool
+	// MaxAge is how long, in seconds, preflight responses may be cached for
+	MaxAge int
+}
+
+// Validate - checks the options are safe. With credentials allowed any origin
+// allowed can make requests as the user, so the origins must be listed, a
+// wildcard only standing for the subdomains of a domain
+func (opts Options) Validate() error {
+	if !opts.AllowCredentials {
+		return nil
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if origin == "*" {
+			return errors.New("Credentials can't be allowed from any origin, list the origins allowed")
+		}
+		if i := strings.Index(origin, "*"); i >= 0 && !subdomainWildcard(origin, i) {
+			return fmt.Errorf("Credentials can't be allowed from %s, a wildcard can only stand for the subdomains of a domain e.g. https://*.example.com", origin)
+		}
+	}
+	return nil
+}
+
+// subdomainWildcard - whether the wildcard at i is the whole of the origin's
+// first label, with at least a domain & top level domain after it
+func subdomainWildcard(origin string, i int) bool {
+	domain := origin[i+1:]
+	return strings.HasSuffix(origin[:i], "://") && strings.HasPrefix(domain, ".") &&
+		strings.Count(domain, ".") >= 2 && !strings.Contains(domain, "*")
+}
+
+// Handler - answers preflight requests & adds the CORS headers to responses
+// for allowed origins. It wraps the router, so preflight requests are answered
+// before routing & authentication
+func Handler(opts Options, next http.Handler) http.Handler {
+	methods := strings.Join(upper(opts.AllowedMethods), ", ")
+	allowAnyHeader := contains(opts.AllowedHeaders, "*")
+	allowedHeaders := lower(opts.AllowedHeaders)
+	exposed := strings.Join(opts.ExposedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the response depends on the origin
+		w.Header().Add("Vary", "Origin")
+		if !originAllowed(opts.AllowedOrigins, origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if contains(opts.AllowedOrigins, "*") && !opts.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if opts.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+		requested := splitHeaders(r.Header.Get("Access-Control-Request-Headers"))
+		if !contains(upper(opts.AllowedMethods), method) || (!allowAnyHeader && !containsAll(allowedHeaders, requested)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		if len(requested) > 0 {
+			// echoing the headers asked for covers * too, which browsers
+			// don't honour alongside credentials
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if opts.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(opts.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// originAllowed - whether the origin matches one of those allowed
+func originAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			prefix, suffix := pattern[:i], pattern[i+1:]
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitHeaders - the header names in a comma separated list, lower cased
+func splitHeaders(value string) []string {
+	var headers []string
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, strings.ToLower(header))
+		}
+	}
+	return headers
+}
+
+func containsAll(list, values []string) bool {
+	for _, value := range values {
+		if !contains(list, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func upper(list []string) []string {
+	upper := make([]string, len(list))
+	for i, item := range list {
+		upper[i] = strings.ToUpper(item)
+	}
+	return upper
+}
+
+func lower(list []string) []string {
+	lower := make([]string, len(list))
+	for i, item := range list {
+		lower[i] = strings.ToLower(item)
+	}
+	return lower
+}
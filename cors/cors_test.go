@@ -0,0 +1,50 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateRefusesAnyOriginWithCredentials(t *testing.T) {
+	for _, origins := range [][]string{
+		{"*"},
+		{"https://app.example.com", "*"},
+		{"https://*"},
+		{"*.example.com"},
+		{"https://*.com"},
+		{"https://app*.example.com"},
+	} {
+		if err := (Options{AllowedOrigins: origins, AllowCredentials: true}).Validate(); err == nil {
+			t.Errorf("Credentials were allowed from %v", origins)
+		}
+		if err := (Options{AllowedOrigins: origins}).Validate(); err != nil {
+			t.Errorf("%v without credentials was refused %v", origins, err)
+		}
+	}
+	listed := Options{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com"}, AllowCredentials: true}
+	if err := listed.Validate(); err != nil {
+		t.Errorf("Listed origins were refused %v", err)
+	}
+}
+
+func TestCredentialsEchoTheOrigin(t *testing.T) {
+	handler := Handler(Options{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{"GET"},
+		AllowCredentials: true,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://example.com.evil": "",
+	} {
+		r := httptest.NewRequest("GET", "/all", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("Allowed %q for %s, want %q", got, origin, want)
+		}
+	}
+}
@@ -2,61 +2,212 @@ package elasticSearch
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
 	es "github.com/olivere/elastic"
 	"github.com/rs/zerolog"
-	log "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type hash map[string]interface{}
 
 // App - represents the es configuration for the folder aggregation client
 type App struct {
-	Verbose          bool
-	ElasticSearchURL string
-	Index            string
-	Client           *es.Client
+	Verbose           bool
+	ElasticSearchURLs []string
+	Index             string
+	Client            *es.Client
+}
+
+// Options - the settings used to connect to the es cluster. Only the URLs are
+// required, everything else is there to support secured clusters
+type Options struct {
+	// URLs of one or more nodes in the cluster
+	URLs []string
+	// Username / Password for basic authentication
+	Username string
+	Password string
+	// APIKey is sent as an "Authorization: ApiKey ..." header, and is an
+	// alternative to basic authentication
+	APIKey string
+	// CACertFile is a PEM encoded certificate authority used to verify the
+	// cluster, for when it's signed by a private CA
+	CACertFile string
+	// ClientCertFile / ClientKeyFile are a PEM encoded certificate & key used
+	// when the cluster requires client certificate authentication
+	ClientCertFile string
+	ClientKeyFile  string
+	// InsecureSkipVerify disables verification of the cluster certificate,
+	// only ever for use in development
+	InsecureSkipVerify bool
+	// Sniff / Healthcheck enable the es client's node discovery & health checks
+	Sniff       bool
+	Healthcheck bool
+	// Logger is given the client's errors, & its requests when verbose
+	Logger zerolog.Logger
 }
 
 // Connect - connects to the es client, & creates the index if needed
-func Connect(verbose bool, esURL, esIndex string) (*App, error) {
+func Connect(verbose bool, esIndex string, opts Options) (*App, error) {
 
-	ctx := context.Background()
+	ctx := logging.WithLogger(context.Background(), opts.Logger)
 
 	// Initialise elastic search
 	var esTraceLog es.Logger
 	if verbose {
-		esTraceLog = elasticLog{log.Logger}
+		esTraceLog = elasticLog{opts.Logger}
 	}
 
-	// connect to the elastic search client
-	client, err := es.NewClient(
-		// es.SetURL(esURL),
-		es.SetErrorLog(elasticLog{log.Logger}),
+	httpClient, err := newHTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := urlScheme(opts.URLs)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := []es.ClientOptionFunc{
+		es.SetURL(opts.URLs...),
+		// sniffed nodes are given the scheme, rather than that of the URLs
+		es.SetScheme(scheme),
+		es.SetHttpClient(httpClient),
+		es.SetErrorLog(elasticLog{opts.Logger}),
 		es.SetTraceLog(esTraceLog),
-		es.SetSniff(false),
-		es.SetHealthcheck(false),
-	)
+		es.SetSniff(opts.Sniff),
+		es.SetHealthcheck(opts.Healthcheck),
+	}
+	if opts.Username != "" {
+		clientOptions = append(clientOptions, es.SetBasicAuth(opts.Username, opts.Password))
+	}
+
+	// connect to the elastic search client
+	client, err := es.NewClient(clientOptions...)
 	if err != nil {
 		return nil, err
 	}
 
 	// ensure the index exists, if not create it
-	_, err = ensureIndexExists(ctx, client, esIndex, tlFolderWatchMapping)
+	created, err := ensureIndexExists(ctx, client, esIndex, tlFolderWatchMapping)
 	if err != nil {
 		return nil, err
 	}
+	if !created {
+		if err := ensureParentPaths(ctx, client, esIndex); err != nil {
+			return nil, err
+		}
+	}
 
 	app := &App{
-		Client:           client,
-		Verbose:          verbose,
-		Index:            esIndex,
-		ElasticSearchURL: esURL,
+		Client:            client,
+		Verbose:           verbose,
+		Index:             esIndex,
+		ElasticSearchURLs: opts.URLs,
 	}
 
 	return app, nil
 }
 
+// newHTTPClient - builds the http client used by the es client, configuring
+// TLS and the API key header where they have been asked for
+func newHTTPClient(opts Options) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read es CA certificate %s %v", opts.CACertFile, err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in es CA certificate %s", opts.CACertFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load es client certificate %s / key %s %v",
+				opts.ClientCertFile, opts.ClientKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	var roundTripper http.RoundTripper = transport
+	if opts.APIKey != "" {
+		roundTripper = apiKeyTransport{apiKey: opts.APIKey, next: transport}
+	}
+
+	return &http.Client{Transport: metrics.InstrumentElasticSearch(roundTripper)}, nil
+}
+
+// urlScheme - the scheme the URLs share, http when none are given. Sniffing
+// gives every node it finds the same scheme, so the URLs can't mix them
+func urlScheme(urls []string) (string, error) {
+	scheme := "http"
+	for i, raw := range urls {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			// the parse error quotes the URL, password & all
+			return "", fmt.Errorf("The es URL at position %d isn't a valid URL", i+1)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return "", fmt.Errorf("The es URL %s must be http or https", parsed.Redacted())
+		}
+		if i > 0 && parsed.Scheme != scheme {
+			return "", errors.New("The es URLs must either all be http or all be https")
+		}
+		scheme = parsed.Scheme
+	}
+	return scheme, nil
+}
+
+// RedactedURLs - the URLs of the es cluster, with any password in them
+// replaced so they can be reported
+func (app *App) RedactedURLs() []string {
+	redacted := make([]string, len(app.ElasticSearchURLs))
+	for i, raw := range app.ElasticSearchURLs {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			// an unparseable URL could be hiding anything
+			redacted[i] = "(invalid)"
+			continue
+		}
+		redacted[i] = parsed.Redacted()
+	}
+	return redacted
+}
+
+// apiKeyTransport - adds the API key authorization header to every request
+// made to the es cluster
+type apiKeyTransport struct {
+	apiKey string
+	next   http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper mustn't modify the request it's been given
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	return t.next.RoundTrip(r)
+}
+
 // ensureIndexExists - checks whether the given index exists, if not creates it
 func ensureIndexExists(ctx context.Context, client *es.Client, indexName, mapping string) (bool, error) {
 	exists, err := client.IndexExists(indexName).Do(ctx)
@@ -73,6 +224,75 @@ func ensureIndexExists(ctx context.Context, client *es.Client, indexName, mappin
 	return false, nil
 }
 
+// ensureParentPaths - adds the parent path to the mapping of an index that
+// was created before it was stored, & sets it on the nodes saved without it
+func ensureParentPaths(ctx context.Context, client *es.Client, indexName string) error {
+	_, err := client.PutMapping().
+		Index(indexName).
+		Type(docType).
+		BodyString(parentPathMapping).
+		Do(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to add parentPath to the mapping of index %s %v", indexName, err)
+	}
+	response, err := client.UpdateByQuery(indexName).
+		Type(docType).
+		Query(es.NewBoolQuery().MustNot(es.NewExistsQuery("parentPath"))).
+		Script(es.NewScript(parentPathScript)).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to set parentPath on the documents in index %s %v", indexName, err)
+	}
+	if response.Updated > 0 {
+		logging.Ctx(ctx).Info().Str("index", indexName).Int64("updated", response.Updated).Msg("Set parentPath on documents saved without it")
+	}
+	return nil
+}
+
+// IndexExists - checks the cluster can be reached & the index exists
+func (config *App) IndexExists(ctx context.Context) (exists bool, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.IndexExists", trace.WithAttributes(attribute.String("es.index", config.Index)))
+	defer func() { tracing.End(span, err) }()
+	return config.Client.IndexExists(config.Index).Do(ctx)
+}
+
+// Count - returns the number of documents in the index
+func (config *App) Count(ctx context.Context) (count int64, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.Count", trace.WithAttributes(attribute.String("es.index", config.Index)))
+	defer func() { tracing.End(span, err) }()
+	count, err = config.Client.Count(config.Index).Do(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to count the documents in index %s %v", config.Index, err)
+	}
+	return count, nil
+}
+
+// ResetIndex - deletes the index, along with every document in it, &
+// creates it afresh
+func (config *App) ResetIndex(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.ResetIndex", trace.WithAttributes(attribute.String("es.index", config.Index)))
+	defer func() { tracing.End(span, err) }()
+	if _, err := config.Client.DeleteIndex(config.Index).Do(ctx); err != nil {
+		return fmt.Errorf("Failed to delete index %s %v", config.Index, err)
+	}
+	if err := createIndex(ctx, config.Client, config.Index, tlFolderWatchMapping); err != nil {
+		return fmt.Errorf("Failed to create index %s %v", config.Index, err)
+	}
+	return nil
+}
+
+// IsUnavailable - whether the error is down to the cluster not being
+// reachable, or not answering in time, rather than the request made of it
+func IsUnavailable(err error) bool {
+	return es.IsConnErr(err) || es.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// IsNotFound - whether the error is down to the index or document not existing
+func IsNotFound(err error) bool {
+	return es.IsNotFound(err)
+}
+
 // createIndex - creates an index
 func createIndex(ctx context.Context, client *es.Client, indexName, mapping string) error {
 	createIndex, err := client.CreateIndex(indexName).BodyString(mapping).Do(ctx)
@@ -3,9 +3,16 @@ package elasticSearch
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
 
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
 	"github.com/olivere/elastic"
-	log "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // FsNode represents a file server node
@@ -14,13 +21,31 @@ type FsNode struct {
 	IsDir         bool   `json:"isDir"`
 	FullPath      string `json:"fullPath"`
 	IsWatchFolder bool   `json:"isWatchFolder"`
+	// ParentPath is the folder the node is directly within, stored so a
+	// folder's children can be matched exactly
+	ParentPath string `json:"parentPath,omitempty"`
 }
 
 const docType = "doc"
 
-// Save - saves the document to elastic search
-func (app *App) Save(fsNode FsNode, id string) error {
-	ctx := context.Background()
+// how many nodes are fetched at a time when scrolling, & how long the index
+// keeps the scroll open between pages
+const (
+	scrollPageSize  = 500
+	scrollKeepAlive = "1m"
+)
+
+var tracer = tracing.Tracer("elasticSearch")
+
+// luceneRegexpReserved - the characters with a meaning in an ElasticSearch
+// regexp query, which must be escaped to be matched literally
+const luceneRegexpReserved = `.?+*|{}[]()"\#@&<>~`
+
+// Save - saves the document to elastic search, along with its parent path
+func (app *App) Save(ctx context.Context, fsNode FsNode, id string) (err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.Save", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.id", id)))
+	defer func() { tracing.End(span, err) }()
+	fsNode.ParentPath = path.Dir(fsNode.FullPath)
 	response, err := app.Client.Index().
 		Index(app.Index).
 		Type(docType).
@@ -30,14 +55,15 @@ func (app *App) Save(fsNode FsNode, id string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Indexed fsNode %s to index %s\n", response.Id, response.Index)
+	logging.Ctx(ctx).Debug().Str("id", response.Id).Str("index", response.Index).Msg("Indexed fsNode")
 	return nil
 }
 
 // Delete - deletes a document from the index given its id
-func (app *App) Delete(id string) error {
-	ctx := context.Background()
-	_, err := app.Client.Delete().
+func (app *App) Delete(ctx context.Context, id string) (err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.Delete", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.id", id)))
+	defer func() { tracing.End(span, err) }()
+	_, err = app.Client.Delete().
 		Index(app.Index).
 		Type(docType).
 		Id(id).
@@ -48,9 +74,70 @@ func (app *App) Delete(id string) error {
 	return nil
 }
 
+// MoveFsNodes - moves everything beneath the old folder path to beneath the
+// new one, for when the folder's been renamed or moved. The nodes are saved
+// under the ids given for their new paths, & deleted from those of their old,
+// in bulk a page at a time. The folder's own document is left to the caller
+func (app *App) MoveFsNodes(ctx context.Context, oldPath, newPath string, id func(FsNode) string) (moved int64, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.MoveFsNodes", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.folder", oldPath)))
+	defer func() { tracing.End(span, err) }()
+
+	bulk := app.Client.Bulk()
+	flush := func() error {
+		if bulk.NumberOfActions() == 0 {
+			return nil
+		}
+		response, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if response.Errors {
+			failed := response.Failed()[0]
+			return fmt.Errorf("Failed to move %s %s", failed.Id, failed.Error.Reason)
+		}
+		bulk = app.Client.Bulk()
+		return nil
+	}
+	err = app.ListFsNodes(ctx, oldPath, 0, func(int64) {}, func(fsNode FsNode) error {
+		bulk.Add(elastic.NewBulkDeleteRequest().Index(app.Index).Type(docType).Id(id(fsNode)))
+		fsNode.FullPath = newPath + strings.TrimPrefix(fsNode.FullPath, oldPath)
+		fsNode.ParentPath = path.Dir(fsNode.FullPath)
+		bulk.Add(elastic.NewBulkIndexRequest().Index(app.Index).Type(docType).Id(id(fsNode)).Doc(fsNode))
+		moved++
+		if bulk.NumberOfActions() >= 2*scrollPageSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	return moved, flush()
+}
+
+// DeleteFsNodes - deletes everything beneath the folder path, for when the
+// folder's been deleted. The folder's own document is left to the caller
+func (app *App) DeleteFsNodes(ctx context.Context, folderPath string) (deleted int64, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.DeleteFsNodes", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.folder", folderPath)))
+	defer func() { tracing.End(span, err) }()
+	folderPath = path.Clean(folderPath)
+	response, err := app.Client.DeleteByQuery(app.Index).
+		Type(docType).
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewTermQuery("fullPath.tree", folderPath)).
+			MustNot(elastic.NewTermQuery("fullPath.keyword", folderPath))).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return response.Deleted, nil
+}
+
 // Get - gets a document from the index given its id
-func (app *App) Get(id string) (FsNode, error) {
-	ctx := context.Background()
+func (app *App) Get(ctx context.Context, id string) (fsNode FsNode, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.Get", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.id", id)))
+	defer func() { tracing.End(span, err) }()
 	doc, err := app.Client.Get().
 		Index(app.Index).
 		Type(docType).
@@ -59,62 +146,125 @@ func (app *App) Get(id string) (FsNode, error) {
 	if err != nil {
 		return FsNode{}, err
 	}
-	var fsNode FsNode
 	json.Unmarshal(*doc.Source, &fsNode)
 	return fsNode, nil
 }
 
-// GetAllFsNodes returns a list of all FsNodes, ordered by folder path
-func (app *App) GetAllFsNodes() ([]FsNode, int64, error) {
-	ctx := context.Background()
-	q := elastic.NewMatchAllQuery()
-	results, err := app.Client.
-		Search().
-		Index(app.Index).
-		Query(q).
-		Sort("fullPath.keyword", true).
-		Pretty(true).
-		Do(ctx)
+// GetAllFsNodes returns a list of all FsNodes, ordered by folder path. They're
+// scrolled through, as a search only returns its first page of hits
+func (app *App) GetAllFsNodes(ctx context.Context) (fsNodes []FsNode, totalHits int64, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.GetAllFsNodes", trace.WithAttributes(attribute.String("es.index", app.Index)))
+	defer func() { tracing.End(span, err) }()
+	return app.collect(ctx, "")
+}
+
+// GetFsNodesForWatchFolder - given the start of a folder path, returns all
+// documents that start with that folderpath, ordered by folder path
+func (app *App) GetFsNodesForWatchFolder(ctx context.Context, folderPath string) (fsNodes []FsNode, totalHits int64, err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.GetFsNodesForWatchFolder", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.folder", folderPath)))
+	defer func() { tracing.End(span, err) }()
+	return app.collect(ctx, folderPath)
+}
+
+// collect - every node ScrollFsNodes scrolls through for the folder path
+func (app *App) collect(ctx context.Context, folderPath string) ([]FsNode, int64, error) {
+	fsNodes := []FsNode{}
+	var totalHits int64
+	err := app.ScrollFsNodes(ctx, folderPath, func(hits int64) {
+		totalHits = hits
+	}, func(fsNode FsNode) error {
+		fsNodes = append(fsNodes, fsNode)
+		return nil
+	})
 	if err != nil {
 		return nil, 0, err
 	}
+	return fsNodes, totalHits, nil
+}
 
-	// process results
-	var fsNodes []FsNode
-	for _, hit := range results.Hits.Hits {
-		var fsn FsNode
-		json.Unmarshal(*hit.Source, &fsn)
-		fsNodes = append(fsNodes, fsn)
-	}
+// ScrollFsNodes - scrolls through the nodes in the folder, or every node when
+// the folder path is empty, ordered by path. start is given the total number
+// of nodes, before each is called with them a page at a time, so they needn't
+// all be held in memory. Stops at the first error each returns
+func (app *App) ScrollFsNodes(ctx context.Context, folderPath string, start func(totalHits int64), each func(FsNode) error) (err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.ScrollFsNodes", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.folder", folderPath)))
+	defer func() { tracing.End(span, err) }()
 
-	return fsNodes, results.Hits.TotalHits, nil
+	var q elastic.Query = elastic.NewMatchAllQuery()
+	if folderPath != "" {
+		q = elastic.NewPrefixQuery("fullPath.tree", folderPath)
+	}
+	return app.scroll(ctx, q, start, each)
 }
 
-// GetFsNodesForWatchFolder - given the start of a folder path, returns all
-// documents that start with that folderpath, ordered by folder path
-func (app *App) GetFsNodesForWatchFolder(folderPath string) ([]FsNode, int64, error) {
-	ctx := context.Background()
+// ListFsNodes - scrolls through the nodes beneath the folder, down to depth
+// levels, or every level when depth is 0, ordered by path. Unlike
+// ScrollFsNodes the folder is matched by whole path segments, so /x/03 never
+// matches /x/03 March. start & each are called as they are by ScrollFsNodes
+func (app *App) ListFsNodes(ctx context.Context, folderPath string, depth int, start func(totalHits int64), each func(FsNode) error) (err error) {
+	ctx, span := tracer.Start(ctx, "elasticSearch.ListFsNodes", trace.WithAttributes(attribute.String("es.index", app.Index), attribute.String("es.folder", folderPath), attribute.Int("es.depth", depth)))
+	defer func() { tracing.End(span, err) }()
 
-	// full path is stroed in elastic search using path_hierarchy tokeniser, see
-	// https://www.elastic.co/guide/en/elasticsearch/reference/current/analysis-pathhierarchy-tokenizer.html
-	q := elastic.NewPrefixQuery("fullPath.tree", folderPath)
-	results, err := app.Client.Search().
-		Index(app.Index).
+	folderPath = path.Clean(folderPath)
+	if depth == 1 {
+		return app.scroll(ctx, elastic.NewTermQuery("parentPath", folderPath), start, each)
+	}
+	q := elastic.NewBoolQuery()
+	if folderPath != "/" {
+		// each ancestor of a path is one of its fullPath.tree tokens, so
+		// this only matches the folder itself & everything beneath it
+		q = q.Filter(elastic.NewTermQuery("fullPath.tree", folderPath)).
+			MustNot(elastic.NewTermQuery("fullPath.keyword", folderPath))
+	}
+	if depth > 1 {
+		pattern := fmt.Sprintf("%s(/[^/]+){1,%d}", escapeRegexp(strings.TrimSuffix(folderPath, "/")), depth)
+		q = q.Filter(elastic.NewRegexpQuery("fullPath.keyword", pattern))
+	}
+	return app.scroll(ctx, q, start, each)
+}
+
+// scroll - scrolls through the nodes the query matches, ordered by path
+func (app *App) scroll(ctx context.Context, q elastic.Query, start func(totalHits int64), each func(FsNode) error) error {
+	scroll := app.Client.Scroll(app.Index).
 		Query(q).
 		Sort("fullPath.keyword", true).
-		Pretty(true).
-		Do(ctx)
-	if err != nil {
-		return nil, 0, err
-	}
+		Size(scrollPageSize).
+		KeepAlive(scrollKeepAlive)
+	// the scroll is cleared even if the request has gone away
+	defer scroll.Clear(context.Background())
 
-	// process results
-	var fsNodes []FsNode
-	for _, hit := range results.Hits.Hits {
-		var fsn FsNode
-		json.Unmarshal(*hit.Source, &fsn)
-		fsNodes = append(fsNodes, fsn)
+	for page := 0; ; page++ {
+		results, err := scroll.Do(ctx)
+		if err == io.EOF {
+			if page == 0 {
+				start(0)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if page == 0 {
+			start(results.Hits.TotalHits)
+		}
+		for _, hit := range results.Hits.Hits {
+			var fsn FsNode
+			json.Unmarshal(*hit.Source, &fsn)
+			if err := each(fsn); err != nil {
+				return err
+			}
+		}
 	}
+}
 
-	return fsNodes, results.Hits.TotalHits, nil
+// escapeRegexp - the text escaped to be matched literally by a regexp query
+func escapeRegexp(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(luceneRegexpReserved, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
 }
@@ -0,0 +1,73 @@
+package elasticSearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olivere/elastic"
+)
+
+// pagedIndex - a fake cluster serving the nodes a page at a time, as a scroll
+// through more of them than a search's default size would
+func pagedIndex(t *testing.T, nodes, pageSize int) *App {
+	page := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodDelete:
+			fmt.Fprint(w, `{"succeeded":true}`)
+			return
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			page = 0
+		case r.URL.Path == "/_search/scroll":
+			page++
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var hits []string
+		for i := page * pageSize; i < nodes && i < (page+1)*pageSize; i++ {
+			hits = append(hits, fmt.Sprintf(`{"_id":"%d","_source":{"name":"%03d","fullPath":"/w/%03d"}}`, i, i, i))
+		}
+		fmt.Fprintf(w, `{"_scroll_id":"s","hits":{"total":%d,"hits":[%s]}}`, nodes, strings.Join(hits, ","))
+	}))
+	t.Cleanup(ts.Close)
+
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{Index: "fsnodes", Client: client}
+}
+
+func TestListingsHoldEveryNodeNotJustTheFirstPage(t *testing.T) {
+	app := pagedIndex(t, 25, 10)
+	for name, list := range map[string]func() ([]FsNode, int64, error){
+		"all":    func() ([]FsNode, int64, error) { return app.GetAllFsNodes(context.Background()) },
+		"folder": func() ([]FsNode, int64, error) { return app.GetFsNodesForWatchFolder(context.Background(), "/w") },
+	} {
+		fsNodes, totalHits, err := list()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(fsNodes) != 25 || totalHits != 25 {
+			t.Fatalf("%s: listed %d of %d nodes, want 25 of 25", name, len(fsNodes), totalHits)
+		}
+		if fsNodes[24].FullPath != "/w/024" {
+			t.Errorf("%s: last node is %s, want /w/024", name, fsNodes[24].FullPath)
+		}
+	}
+}
+
+func TestListingNothingIsEmptyNotNull(t *testing.T) {
+	fsNodes, totalHits, err := pagedIndex(t, 0, 10).GetAllFsNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsNodes == nil || totalHits != 0 {
+		t.Errorf("Listed %v of %d nodes, want an empty list", fsNodes, totalHits)
+	}
+}
@@ -41,8 +41,26 @@ const tlFolderWatchMapping = `{
         },
         "isWatchFolder" : {
           "type" : "boolean"
+        },
+        "parentPath" : {
+          "type" : "keyword"
         }
       }
     }
   }
 }`
+
+// parentPathMapping - adds the parent path to an index created before it was
+// stored
+const parentPathMapping = `{
+  "properties" : {
+    "parentPath" : {
+      "type" : "keyword"
+    }
+  }
+}`
+
+// parentPathScript - sets the parent path of a node from its full path, as
+// path.Dir does
+const parentPathScript = `int i = ctx._source.fullPath.lastIndexOf('/');
+ctx._source.parentPath = i > 0 ? ctx._source.fullPath.substring(0, i) : '/';`
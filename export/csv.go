@@ -0,0 +1,53 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// byteOrderMark - lets Excel know the CSV is UTF-8, otherwise names such as
+// Jardinières are garbled
+const byteOrderMark = "\ufeff"
+
+// csvWriter - writes a header row of the columns, then a row per node
+type csvWriter struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func newCSVWriter(w io.Writer, columns []string) (*csvWriter, error) {
+	if _, err := io.WriteString(w, byteOrderMark); err != nil {
+		return nil, err
+	}
+	c := &csvWriter{writer: csv.NewWriter(w), columns: columns}
+	if err := c.writer.Write(columns); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvWriter) Write(fsNode elasticSearch.FsNode) error {
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		field, _ := value(fsNode, column)
+		record[i] = neutralise(field)
+	}
+	return c.writer.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// neutralise - stops a name being taken as a formula by spreadsheets, by
+// quoting it as they would text typed in, e.g. =SUM(A1).pdf
+func neutralise(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
@@ -0,0 +1,109 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// the formats listings can be exported in
+const (
+	NDJSON = "ndjson"
+	CSV    = "csv"
+	XML    = "xml"
+	XLSX   = "xlsx"
+)
+
+// ContentTypes - the media type of each format
+var ContentTypes = map[string]string{
+	NDJSON: "application/x-ndjson",
+	CSV:    "text/csv; charset=utf-8",
+	XML:    "application/xml; charset=utf-8",
+	XLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Columns - the FsNode fields that can be exported, in the order they're
+// exported by default
+var Columns = []string{"name", "isDir", "fullPath", "isWatchFolder"}
+
+// Writer - writes nodes in a format one at a time, so a listing needn't be
+// held in memory to be exported. Close finishes the export
+type Writer interface {
+	Write(fsNode elasticSearch.FsNode) error
+	Close() error
+}
+
+// New - a writer of the format, exporting the columns
+func New(format string, w io.Writer, columns []string) (Writer, error) {
+	switch format {
+	case NDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case CSV:
+		return newCSVWriter(w, columns)
+	case XML:
+		return newXMLWriter(w, columns)
+	case XLSX:
+		return newXLSXWriter(w, columns)
+	}
+	return nil, fmt.Errorf("Unknown export format %s", format)
+}
+
+// ParseColumns - the columns in a comma separated list, every column when
+// it's empty
+func ParseColumns(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return Columns, nil
+	}
+	var columns []string
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if !contains(Columns, column) {
+			return nil, fmt.Errorf("Unknown column %q, give any of %s", column, strings.Join(Columns, ", "))
+		}
+		if !contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+// value - the node's value for the column, & whether it's a boolean
+func value(fsNode elasticSearch.FsNode, column string) (string, bool) {
+	switch column {
+	case "name":
+		return fsNode.Name, false
+	case "isDir":
+		return strconv.FormatBool(fsNode.IsDir), true
+	case "fullPath":
+		return fsNode.FullPath, false
+	case "isWatchFolder":
+		return strconv.FormatBool(fsNode.IsWatchFolder), true
+	}
+	return "", false
+}
+
+// ndjsonWriter - writes each node as a line of JSON, always with every field
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(fsNode elasticSearch.FsNode) error {
+	return n.encoder.Encode(fsNode)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// testNodes - a folder, & a file whose name a spreadsheet would evaluate
+func testNodes() []elasticSearch.FsNode {
+	return []elasticSearch.FsNode{
+		{Name: "Jardinières", FullPath: "/w/Jardinières", IsDir: true, IsWatchFolder: true},
+		{Name: "=SUM(A1).pdf", FullPath: "/w/Jardinières/=SUM(A1).pdf"},
+	}
+}
+
+// export - the nodes exported in the format
+func export(t *testing.T, format string, columns []string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := New(format, &buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fsNode := range testNodes() {
+		if err := writer.Write(fsNode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseColumns(t *testing.T) {
+	for value, want := range map[string][]string{
+		"":                       Columns,
+		"fullPath":               {"fullPath"},
+		" name , isDir,name":     {"name", "isDir"},
+		"isWatchFolder,fullPath": {"isWatchFolder", "fullPath"},
+	} {
+		if got, err := ParseColumns(value); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseColumns(%q) = %v %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := ParseColumns("name,size"); err == nil || !strings.Contains(err.Error(), "size") {
+		t.Errorf("An unknown column gave %v, want it named", err)
+	}
+}
+
+func TestUnknownFormatsAreRefused(t *testing.T) {
+	if _, err := New("pdf", io.Discard, Columns); err == nil {
+		t.Error("A pdf writer was made")
+	}
+}
+
+func TestNDJSONHasANodePerLine(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(string(export(t, NDJSON, []string{"name"}))), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Exported %d lines, want 2", len(lines))
+	}
+	// every field is exported, whatever the columns
+	var fsNode elasticSearch.FsNode
+	if err := json.Unmarshal([]byte(lines[1]), &fsNode); err != nil || fsNode != testNodes()[1] {
+		t.Errorf("Exported %s %v, want %+v", lines[1], err, testNodes()[1])
+	}
+}
+
+func TestCSVHasAHeaderAndNeutralisesFormulas(t *testing.T) {
+	exported := string(export(t, CSV, []string{"fullPath", "isDir"}))
+	if !strings.HasPrefix(exported, byteOrderMark) {
+		t.Error("Exported without a byte order mark")
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(exported, byteOrderMark))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"fullPath", "isDir"},
+		{"/w/Jardinières", "true"},
+		{"/w/Jardinières/=SUM(A1).pdf", "false"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("Exported %q, want %q", records, want)
+	}
+	if got := neutralise("=SUM(A1).pdf"); got != "'=SUM(A1).pdf" {
+		t.Errorf("Neutralised as %q", got)
+	}
+}
+
+func TestXMLHasAnElementPerColumn(t *testing.T) {
+	var listing struct {
+		FsNodes []struct {
+			Name  string `xml:"name"`
+			IsDir string `xml:"isDir"`
+		} `xml:"fsNode"`
+	}
+	if err := xml.Unmarshal(export(t, XML, []string{"name", "isDir"}), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.FsNodes) != 2 || listing.FsNodes[1].Name != "=SUM(A1).pdf" || listing.FsNodes[0].IsDir != "true" {
+		t.Errorf("Exported %+v", listing.FsNodes)
+	}
+}
+
+func TestXLSXIsAWorkbook(t *testing.T) {
+	exported := export(t, XLSX, []string{"name", "isDir"})
+	archive, err := zip.NewReader(bytes.NewReader(exported), int64(len(exported)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet []byte
+	for _, file := range archive.File {
+		if file.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sheet, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(archive.File) != len(xlsxParts)+1 || sheet == nil {
+		t.Fatalf("The workbook holds %d parts, want the sheet & %d others", len(archive.File), len(xlsxParts))
+	}
+	if rows := strings.Count(string(sheet), "<row>"); rows != 3 {
+		t.Errorf("The sheet has %d rows, want a header & 2 nodes", rows)
+	}
+	// names are inline strings, which are never evaluated
+	if !strings.Contains(string(sheet), stringCell("=SUM(A1).pdf")) || !strings.Contains(string(sheet), boolCell(true)) {
+		t.Errorf("The sheet holds %s", sheet)
+	}
+	if err := xml.Unmarshal(sheet, new(struct{})); err != nil {
+		t.Errorf("The sheet isn't valid XML %v", err)
+	}
+}
+
+func TestXLSXRowsAreLimited(t *testing.T) {
+	writer, err := New(XLSX, io.Discard, Columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.(*xlsxWriter).rows = maxXLSXRows
+	if err := writer.Write(testNodes()[0]); err == nil {
+		t.Error("A row was written past the most a sheet can hold")
+	}
+}
@@ -0,0 +1,117 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// maxXLSXRows - the most rows a sheet can hold, header included
+const maxXLSXRows = 1048576
+
+// the parts of the workbook other than its one sheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Listing" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxWriter - writes a workbook with a single sheet, whose first row is the
+// columns. The sheet is written last, so its rows can be streamed into the
+// zip as they come
+type xlsxWriter struct {
+	archive *zip.Writer
+	sheet   *bufio.Writer
+	columns []string
+	rows    int
+}
+
+func newXLSXWriter(w io.Writer, columns []string) (*xlsxWriter, error) {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(file, part.content); err != nil {
+			return nil, err
+		}
+	}
+	file, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &xlsxWriter{archive: archive, sheet: bufio.NewWriter(file), columns: columns}
+	x.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = stringCell(column)
+	}
+	return x, x.row(header)
+}
+
+func (x *xlsxWriter) Write(fsNode elasticSearch.FsNode) error {
+	cells := make([]string, len(x.columns))
+	for i, column := range x.columns {
+		field, isBool := value(fsNode, column)
+		if isBool {
+			cells[i] = boolCell(field == "true")
+		} else {
+			cells[i] = stringCell(field)
+		}
+	}
+	return x.row(cells)
+}
+
+func (x *xlsxWriter) Close() error {
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.archive.Close()
+}
+
+func (x *xlsxWriter) row(cells []string) error {
+	if x.rows == maxXLSXRows {
+		return fmt.Errorf("The listing has more than the %d rows a spreadsheet can hold", maxXLSXRows-1)
+	}
+	x.rows++
+	x.sheet.WriteString("<row>")
+	for _, cell := range cells {
+		x.sheet.WriteString(cell)
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+// stringCell - an inline string cell, escaped as XML text. Spreadsheets don't
+// evaluate inline strings, so they're never taken as a formula
+func stringCell(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return `<c t="inlineStr"><is><t xml:space="preserve">` + escaped.String() + `</t></is></c>`
+}
+
+func boolCell(value bool) string {
+	if value {
+		return `<c t="b"><v>1</v></c>`
+	}
+	return `<c t="b"><v>0</v></c>`
+}
@@ -0,0 +1,48 @@
+package export
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// xmlWriter - writes <fsNodes> holding an <fsNode> per node, with an element
+// for each column
+type xmlWriter struct {
+	encoder *xml.Encoder
+	columns []string
+}
+
+func newXMLWriter(w io.Writer, columns []string) (*xmlWriter, error) {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return nil, err
+	}
+	x := &xmlWriter{encoder: xml.NewEncoder(w), columns: columns}
+	if err := x.encoder.EncodeToken(xml.StartElement{Name: xml.Name{Local: "fsNodes"}}); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xmlWriter) Write(fsNode elasticSearch.FsNode) error {
+	node := xml.StartElement{Name: xml.Name{Local: "fsNode"}}
+	if err := x.encoder.EncodeToken(node); err != nil {
+		return err
+	}
+	for _, column := range x.columns {
+		field, _ := value(fsNode, column)
+		// the encoder escapes the text, & replaces characters XML can't hold
+		if err := x.encoder.EncodeElement(field, xml.StartElement{Name: xml.Name{Local: column}}); err != nil {
+			return err
+		}
+	}
+	return x.encoder.EncodeToken(node.End())
+}
+
+func (x *xmlWriter) Close() error {
+	if err := x.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "fsNodes"}}); err != nil {
+		return err
+	}
+	return x.encoder.Flush()
+}
@@ -1,71 +1,672 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	log "github.com/rs/zerolog/log"
-
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/cache"
+	"github.com/clwilliams/tlWatchFolderAggregator/consumer"
 	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/export"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
 )
 
-// GetAll returns a list of articles
-func GetAll(config *elasticSearch.App) http.Handler {
+// FsNodeStore - the store folder listings are read from
+type FsNodeStore interface {
+	Get(ctx context.Context, id string) (elasticSearch.FsNode, error)
+	GetAllFsNodes(ctx context.Context) ([]elasticSearch.FsNode, int64, error)
+	GetFsNodesForWatchFolder(ctx context.Context, folderPath string) ([]elasticSearch.FsNode, int64, error)
+	ScrollFsNodes(ctx context.Context, folderPath string, start func(totalHits int64), each func(elasticSearch.FsNode) error) error
+	ListFsNodes(ctx context.Context, folderPath string, depth int, start func(totalHits int64), each func(elasticSearch.FsNode) error) error
+}
+
+// listingScroll - scrolls through the nodes of a listing, ordered by path.
+// start is only called when the total count is known up front
+type listingScroll func(ctx context.Context, start func(totalHits int64), each func(elasticSearch.FsNode) error) error
+
+// maxListDepth - the deepest a recursive listing can be limited to
+const maxListDepth = 100
+
+// streamWriteTimeout - how long a client may take to read each part of a
+// listing streamed in an export format. The server's write timeout covers the
+// whole response, so it's pushed back as the listing's written, rather than
+// cutting off a large export part way through
+const streamWriteTimeout = time.Minute
+
+// formatJSON - listings are a JSON array unless another format is asked for,
+// those being streamed in the export formats
+const formatJSON = "json"
+
+// formatMediaTypes - the format for each media type that can be accepted
+var formatMediaTypes = map[string]string{
+	"application/json":     formatJSON,
+	"application/x-ndjson": export.NDJSON,
+	"text/csv":             export.CSV,
+	"application/xml":      export.XML,
+	"text/xml":             export.XML,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": export.XLSX,
+}
+
+// GetAll returns a list of articles, or 304 when the caller already has it
+func GetAll(store FsNodeStore, listings *cache.Listings) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		format, columns, err := listingFormat(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listings.Version(), format) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		principal := auth.FromContext(r.Context())
+		if format != formatJSON {
+			// an empty folder scrolls every node
+			folders := []string{""}
+			if !principal.Unrestricted() {
+				folders = principal.Prefixes
+			}
+			streamFsNodes(w, r, scrollFolders(store, principal, folders), format, columns)
+			return
+		}
+		var fsNodes []elasticSearch.FsNode
+		var totalHits int64
+		if principal.Unrestricted() {
+			fsNodes, totalHits, err = store.GetAllFsNodes(r.Context())
+		} else {
+			fsNodes, totalHits, err = listFolders(r.Context(), store, principal, principal.Prefixes)
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeFsNodes(w, r, fsNodes, totalHits)
+	})
+}
+
+// GetFsNodesForWatchFolder returns a list of articles, or 304 when the caller
+// already has it
+func GetFsNodesForWatchFolder(store FsNodeStore, listings *cache.Listings) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		folder, err := folderParam(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		folders, err := authorizedFolders(auth.FromContext(r.Context()), folder)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		format, columns, err := listingFormat(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listings.Version(), format) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if format != formatJSON {
+			streamFsNodes(w, r, scrollFolders(store, auth.FromContext(r.Context()), folders), format, columns)
+			return
+		}
+		fsNodes, totalHits, err := listFolders(r.Context(), store, auth.FromContext(r.Context()), folders)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeFsNodes(w, r, fsNodes, totalHits)
+	})
+}
+
+// GetList returns the nodes directly within the folder, or every node beneath
+// it down to the depth when recursive, or 304 when the caller already has it.
+// Unlike /watch the folder is matched by whole path segments
+func GetList(store FsNodeStore, listings *cache.Listings) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		folder, err := folderParam(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		folder = path.Clean(folder)
+		depth, err := depthParams(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		principal := auth.FromContext(r.Context())
+		if _, err := authorizedFolders(principal, folder); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		format, columns, err := listingFormat(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if notModified(w, r, listings.Version(), format) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		scroll := scrollList(store, principal, folder, depth)
+		if format != formatJSON {
+			streamFsNodes(w, r, scroll, format, columns)
+			return
+		}
+		fsNodes := []elasticSearch.FsNode{}
+		err = scroll(r.Context(), func(int64) {}, func(fsNode elasticSearch.FsNode) error {
+			fsNodes = append(fsNodes, fsNode)
+			return nil
+		})
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeFsNodes(w, r, fsNodes, int64(len(fsNodes)))
+	})
+}
+
+// depthParams - how many levels to list, from the recursive & depth query
+// parameters. 1 unless recursive, when it's the depth given or 0 for every
+// level
+func depthParams(r *http.Request) (int, error) {
+	query := r.URL.Query()
+	recursive := false
+	if value := query.Get("recursive"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return 0, badRequest("The recursive parameter must be true or false, not %q", value)
+		}
+		recursive = parsed
+	}
+	value := query.Get("depth")
+	if value == "" {
+		if recursive {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if !recursive {
+		return 0, badRequest("The depth parameter can only be given with recursive=true")
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 1 || depth > maxListDepth {
+		return 0, badRequest("The depth parameter must be between 1 & %d", maxListDepth)
+	}
+	return depth, nil
+}
+
+// folderParam - the folder query parameter, which must be given once
+func folderParam(r *http.Request) (string, error) {
+	folders := r.URL.Query()["folder"]
+	switch {
+	case len(folders) == 0:
+		return "", badRequest("The folder parameter must be set")
+	case len(folders) > 1:
+		return "", badRequest("The folder parameter can only be given once")
+	case strings.TrimSpace(folders[0]) == "":
+		return "", badRequest("The folder parameter can't be empty")
+	}
+	return folders[0], nil
+}
+
+// authorizedFolders - the folders to list for the folder requested. That's
+// the folder itself when the principal may see it, otherwise the prefixes
+// they're granted beneath it
+func authorizedFolders(principal *auth.Principal, folder string) ([]string, error) {
+	if principal.Allows(folder) {
+		return []string{folder}, nil
+	}
+	var folders []string
+	for _, prefix := range principal.Prefixes {
+		if strings.HasPrefix(prefix, strings.TrimSuffix(path.Clean(folder), "/")+"/") {
+			folders = append(folders, prefix)
+		}
+	}
+	if len(folders) == 0 {
+		return nil, NewAPIError(http.StatusForbidden, CodeForbidden, "You aren't allowed to see %s", folder)
+	}
+	return folders, nil
+}
+
+// listFolders - the nodes in each of the folders, ordered by path. Only the
+// nodes the principal may see are returned, the store's prefix matching not
+// being bounded by path separators. Across several folders only the nodes
+// within each by whole path segments are kept, so none is listed twice
+func listFolders(ctx context.Context, store FsNodeStore, principal *auth.Principal, folders []string) ([]elasticSearch.FsNode, int64, error) {
+	folders = outermostFolders(folders)
+	var fsNodes []elasticSearch.FsNode
+	var totalHits int64
+	for _, folder := range folders {
+		listed, hits, err := store.GetFsNodesForWatchFolder(ctx, folder)
+		if err != nil {
+			return nil, 0, err
+		}
+		totalHits += hits
+		for _, fsNode := range listed {
+			if principal.Allows(fsNode.FullPath) && (len(folders) == 1 || withinFolder(fsNode.FullPath, folder)) {
+				fsNodes = append(fsNodes, fsNode)
+			} else {
+				totalHits--
+			}
+		}
+	}
+	if len(folders) > 1 {
+		sort.SliceStable(fsNodes, func(i, j int) bool { return fsNodes[i].FullPath < fsNodes[j].FullPath })
+	}
+	return fsNodes, totalHits, nil
+}
+
+// scrollFolders - scrolls through the nodes in each of the folders the
+// principal may see. The total count is only known up front when the
+// principal may see every node of a single folder
+func scrollFolders(store FsNodeStore, principal *auth.Principal, folders []string) listingScroll {
+	folders = outermostFolders(folders)
+	return func(ctx context.Context, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+		if len(folders) != 1 {
+			return scrollWithin(ctx, store, folders, allowed(principal, each))
+		}
+		return store.ScrollFsNodes(ctx, folders[0], func(totalHits int64) {
+			if principal.Unrestricted() {
+				start(totalHits)
+			}
+		}, allowed(principal, each))
+	}
+}
+
+// outermostFolders - the folders ordered by path, leaving out those within
+// another, whose nodes would otherwise be listed twice
+func outermostFolders(folders []string) []string {
+	sorted := append([]string(nil), folders...)
+	sort.Strings(sorted)
+	var outermost []string
+	for _, folder := range sorted {
+		within := false
+		for _, outer := range outermost {
+			within = within || withinFolder(folder, outer)
+		}
+		if !within {
+			outermost = append(outermost, folder)
+		}
+	}
+	return outermost
+}
+
+// scrollWithin - calls each with the nodes within the folders by whole path
+// segments, ordered by path, none of the folders being within another. A
+// folder's own node can sort before another folder whose path it starts,
+// e.g. /x/03 before /x/03 March, while the nodes beneath it sort after, as
+// ' ' comes before '/'. So each folder is looked up, & the nodes beneath it
+// listed, in turn
+func scrollWithin(ctx context.Context, store FsNodeStore, folders []string, each func(elasticSearch.FsNode) error) error {
+	type part struct {
+		key, folder string
+		beneath     bool
+	}
+	parts := make([]part, 0, 2*len(folders))
+	for _, folder := range folders {
+		parts = append(parts, part{key: folder, folder: folder}, part{key: strings.TrimSuffix(folder, "/") + "/", folder: folder, beneath: true})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].key < parts[j].key })
+	for _, part := range parts {
+		if part.beneath {
+			if err := store.ListFsNodes(ctx, part.folder, 0, func(int64) {}, each); err != nil {
+				return err
+			}
+			continue
+		}
+		fsNode, err := lookupNode(ctx, store, part.folder)
+		if err != nil {
+			return err
+		}
+		if fsNode != nil {
+			if err := each(*fsNode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scrollList - scrolls through the nodes beneath the folder, down to the
+// depth, that the principal may see. The total count is only known up front
+// when the principal may see the whole folder
+func scrollList(store FsNodeStore, principal *auth.Principal, folder string, depth int) listingScroll {
+	return func(ctx context.Context, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+		return store.ListFsNodes(ctx, folder, depth, func(totalHits int64) {
+			if principal.Allows(folder) {
+				start(totalHits)
+			}
+		}, allowed(principal, each))
+	}
+}
+
+// allowed - calls each with only the nodes the principal may see
+func allowed(principal *auth.Principal, each func(elasticSearch.FsNode) error) func(elasticSearch.FsNode) error {
+	return func(fsNode elasticSearch.FsNode) error {
+		if !principal.Allows(fsNode.FullPath) {
+			return nil
+		}
+		return each(fsNode)
+	}
+}
+
+// writeFsNodes - writes the listing, along with its total count
+func writeFsNodes(w http.ResponseWriter, r *http.Request, fsNodes []elasticSearch.FsNode, totalHits int64) {
+	js, err := json.Marshal(fsNodes)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	totalCountHeader(w, totalHits)
+	w.Write(js)
+}
+
+// listingFormat - the format the listing was asked for in, by the format
+// parameter or else the Accept header, along with the columns to export. JSON
+// unless another format is asked for
+func listingFormat(r *http.Request) (string, []string, error) {
+	columns, err := export.ParseColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		return "", nil, badRequest("%v", err)
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format != formatJSON && export.ContentTypes[format] == "" {
+			return "", nil, badRequest("Unknown format %q, give any of json, ndjson, csv, xml or xlsx", format)
+		}
+		return format, columns, nil
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(accepted, ";")
+		if format, ok := formatMediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]; ok && !refused(params[1:]) {
+			return format, columns, nil
+		}
+	}
+	return formatJSON, columns, nil
+}
+
+// refused - whether the media type parameters give it a quality of 0
+func refused(params []string) bool {
+	for _, param := range params {
+		if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+			quality, err := strconv.ParseFloat(q[2:], 64)
+			return err == nil && quality == 0
+		}
+	}
+	return false
+}
+
+// streamFsNodes - writes the nodes of the listing in the export format, as
+// they're scrolled from the store, so memory use stays flat however many
+// there are. Once the response is under way an error can only abort it, so
+// the caller sees it's incomplete
+func streamFsNodes(w http.ResponseWriter, r *http.Request, scroll listingScroll, format string, columns []string) {
+	w.Header().Set("Content-Type", export.ContentTypes[format])
+	if format == export.CSV || format == export.XLSX {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="listing.%s"`, format))
+	}
+	// nothing is written until the first node, or the end of the listing,
+	// so an error before then can still be reported
+	body := &lazyWriter{w: w, response: http.NewResponseController(w)}
+	body.extendDeadline()
+	writer, err := export.New(format, body, columns)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	abort := func(err error) {
+		if !body.started {
+			WriteError(w, r, err)
+			return
+		}
+		logging.Ctx(r.Context()).Error().Err(err).Msg("Failed part way through streaming the listing")
+		panic(http.ErrAbortHandler)
+	}
+	err = scroll(r.Context(), func(totalHits int64) {
+		totalCountHeader(w, totalHits)
+	}, func(fsNode elasticSearch.FsNode) error {
+		body.start()
+		return writer.Write(fsNode)
+	})
+	if err != nil {
+		abort(err)
+		return
+	}
+	body.start()
+	if err := writer.Close(); err != nil {
+		abort(err)
+	}
+}
+
+// lazyWriter - holds back what's written, e.g. a header row, until the
+// response is started, then keeps pushing back the response's write deadline
+type lazyWriter struct {
+	w        io.Writer
+	response *http.ResponseController
+	deadline time.Time
+	held     []byte
+	started  bool
+}
+
+func (l *lazyWriter) Write(data []byte) (int, error) {
+	if !l.started {
+		l.held = append(l.held, data...)
+		return len(data), nil
+	}
+	l.extendDeadline()
+	return l.w.Write(data)
+}
+
+// extendDeadline - gives the response another streamWriteTimeout to be
+// written in, once half the last has gone
+func (l *lazyWriter) extendDeadline() {
+	now := time.Now()
+	if l.deadline.Sub(now) > streamWriteTimeout/2 {
+		return
+	}
+	// responses that can't have their deadline set, e.g. when recorded in
+	// tests, have no server write timeout to outlast
+	if err := l.response.SetWriteDeadline(now.Add(streamWriteTimeout)); err == nil {
+		l.deadline = now.Add(streamWriteTimeout)
+	}
+}
+
+func (l *lazyWriter) start() {
+	if l.started {
+		return
+	}
+	l.started = true
+	if len(l.held) > 0 {
+		l.w.Write(l.held)
+		l.held = nil
+	}
+}
+
+// GetHealth returns the state of the connection to the message broker,
+// responding 503 whilst the consumer is disconnected
+func GetHealth(rabbitMQConsumer *consumer.Consumer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		corsResponseHeader(w, false)
+		jsonResponseHeader(w)
 
-		fsNodes, totalHits, err := config.GetAllFsNodes()
+		status := rabbitMQConsumer.Status()
+		js, err := json.Marshal(map[string]interface{}{"broker": status})
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to retrieve all the documents from elastic search")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
+		}
+		if !status.Connected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(js)
+	})
+}
+
+// readinessTimeout - how long the readiness checks have to reach ElasticSearch
+const readinessTimeout = 2 * time.Second
+
+// started - when the process started, reported by the status endpoint
+var started = time.Now()
+
+// GetHealthz returns 200 whilst the process is alive & serving requests
+func GetHealthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+}
+
+// GetReadyz returns 200 once ElasticSearch can be reached, the index exists
+// & every consumer is consuming all its bindings, otherwise 503 along with
+// the checks that failed
+func GetReadyz(config *elasticSearch.App, consumers []*consumer.Consumer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		checks := map[string]string{}
+		ready := true
+		fail := func(check string, err error) {
+			checks[check] = err.Error()
+			ready = false
+		}
+
+		exists, err := config.IndexExists(ctx)
+		switch {
+		case err != nil:
+			fail("elasticsearch", err)
+		case !exists:
+			fail("elasticsearch", fmt.Errorf("Index %s doesn't exist", config.Index))
+		default:
+			checks["elasticsearch"] = "ok"
+		}
+		for _, messageConsumer := range consumers {
+			if err := messageConsumer.Ready(); err != nil {
+				fail(messageConsumer.Source(), err)
+				continue
+			}
+			checks[messageConsumer.Source()] = "ok"
 		}
 
-		js, err := json.Marshal(fsNodes)
+		js, err := json.Marshal(map[string]interface{}{"ready": ready, "checks": checks})
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error marshalling elastic search documents")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
-		corsResponseHeaderTotalCount(w, totalHits)
 		w.Write(js)
 	})
 }
 
-// GetFsNodesForWatchFolder returns a list of articles
-func GetFsNodesForWatchFolder(config *elasticSearch.App) http.Handler {
+// consumerStatus - the state of a consumer, as reported by the status endpoint
+type consumerStatus struct {
+	Source   string                   `json:"source"`
+	Broker   consumer.Status          `json:"broker"`
+	Bindings []consumer.BindingStatus `json:"bindings"`
+}
+
+// GetStatus returns the detailed state of the aggregator: its consumers &
+// their bindings, ElasticSearch & the number of errors reported
+func GetStatus(config *elasticSearch.App, consumers []*consumer.Consumer, errorCount func() int64) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		corsResponseHeader(w, false)
+		jsonResponseHeader(w)
 
-		folder, ok := r.URL.Query()["folder"]
-		if !ok {
-			http.Error(w, "folder argument must be set", http.StatusInternalServerError)
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		esStatus := map[string]interface{}{
+			"urls":  config.RedactedURLs(),
+			"index": config.Index,
 		}
-		fsNodes, totalHits, err := config.GetFsNodesForWatchFolder(folder[0])
+		if exists, err := config.IndexExists(ctx); err != nil {
+			esStatus["error"] = err.Error()
+		} else {
+			esStatus["indexExists"] = exists
+			if documents, err := config.Count(ctx); err == nil {
+				esStatus["documents"] = documents
+			}
+		}
+
+		var consumerStatuses []consumerStatus
+		var lastMessage *time.Time
+		for _, messageConsumer := range consumers {
+			bindings := messageConsumer.Bindings()
+			for _, binding := range bindings {
+				if binding.LastMessage != nil && (lastMessage == nil || binding.LastMessage.After(*lastMessage)) {
+					lastMessage = binding.LastMessage
+				}
+			}
+			consumerStatuses = append(consumerStatuses, consumerStatus{
+				Source:   messageConsumer.Source(),
+				Broker:   messageConsumer.Status(),
+				Bindings: bindings,
+			})
+		}
+
+		js, err := json.Marshal(map[string]interface{}{
+			"started":       started,
+			"uptime":        time.Since(started).Round(time.Second).String(),
+			"consumers":     consumerStatuses,
+			"lastMessage":   lastMessage,
+			"errors":        errorCount(),
+			"elasticsearch": esStatus,
+		})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
 		}
+		w.Write(js)
+	})
+}
 
-		js, err := json.Marshal(fsNodes)
+// PostReload re-reads the configuration file and applies it, without
+// restarting the aggregator. Only admin principals may reload it
+func PostReload(reload func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		if principal := auth.FromContext(r.Context()); principal == nil || !principal.Admin {
+			WriteError(w, r, NewAPIError(http.StatusForbidden, CodeForbidden, "Only admins may reload the configuration"))
+			return
+		}
+		if err := reload(); err != nil {
+			WriteError(w, r, badRequest("%v", err))
+			return
+		}
+		js, err := json.Marshal(map[string]bool{"reloaded": true})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, r, err)
+			return
 		}
-		corsResponseHeaderTotalCount(w, totalHits)
 		w.Write(js)
 	})
 }
 
-// all responses need this set when fulfilling the request
-func corsResponseHeader(w http.ResponseWriter, includeTimeout bool) {
+// all responses need this set when fulfilling the request, the CORS headers
+// are added by the cors handler wrapping the router
+func jsonResponseHeader(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
-	if includeTimeout {
-		w.Header().Set("Access-Control-Max-Age", "1728000")
-	}
 }
 
 // responses returning multiple items need this when fulfilling the response
-func corsResponseHeaderTotalCount(w http.ResponseWriter, count int64) {
-	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
+func totalCountHeader(w http.ResponseWriter, count int64) {
 	w.Header().Set("X-Total-Count", strconv.FormatInt(count, 10))
 }
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/cache"
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/gorilla/mux"
+	es "github.com/olivere/elastic"
+)
+
+// testNodes - a watch folder, with a folder whose name starts like another's
+func testNodes() []elasticSearch.FsNode {
+	return []elasticSearch.FsNode{
+		{Name: "w", FullPath: "/w", IsDir: true, IsWatchFolder: true},
+		{Name: "2019", FullPath: "/w/2019", IsDir: true},
+		{Name: "2019 old", FullPath: "/w/2019 old", IsDir: true},
+		{Name: "a.pdf", FullPath: "/w/2019/a.pdf"},
+		{Name: "03", FullPath: "/w/2019/03", IsDir: true},
+		{Name: "b.pdf", FullPath: "/w/2019/03/b.pdf"},
+	}
+}
+
+// newRouter - routes the listings as main does, along with a route that
+// panics
+func newRouter(store FsNodeStore) http.Handler {
+	listings := cache.New(0)
+	router := mux.NewRouter()
+	router.Use(RecoverPanics)
+	router.NotFoundHandler = NotFound()
+	router.MethodNotAllowedHandler = MethodNotAllowed()
+	router.Handle("/all", GetAll(store, listings)).Methods("GET")
+	router.Handle("/watch", GetFsNodesForWatchFolder(store, listings)).Methods("GET")
+	router.Handle("/list", GetList(store, listings)).Methods("GET")
+	router.Handle("/panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("Can't carry on")
+	})).Methods("GET")
+	return router
+}
+
+// request - makes the request of the handler, returning the response
+func request(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// expectError - the response must be the error envelope with the status &
+// code
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) *APIError {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("Responded %d %s, want %d", w.Code, w.Body, status)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Responded with %s, want application/json", contentType)
+	}
+	var body map[string]*APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == nil {
+		t.Fatalf("Responded %s, want an error envelope %v", w.Body, err)
+	}
+	if apiErr := body["error"]; apiErr.Status != status || apiErr.Code != code {
+		t.Errorf("Responded with error %+v, want %d %s", apiErr, status, code)
+	}
+	return body["error"]
+}
+
+func TestListingsNeedASingleFolder(t *testing.T) {
+	router := newRouter(newMemoryStore(testNodes()...))
+	for _, target := range []string{
+		"/watch", "/watch?folder=", "/watch?folder=%20", "/watch?folder=/w&folder=/x",
+		"/list", "/list?folder=", "/list?folder=/w&folder=/x",
+	} {
+		t.Run(target, func(t *testing.T) {
+			expectError(t, request(router, "GET", target), http.StatusBadRequest, CodeBadRequest)
+		})
+	}
+}
+
+func TestListingsAreUnavailableWithoutElasticSearch(t *testing.T) {
+	store := newMemoryStore(testNodes()...)
+	store.err = es.ErrNoClient
+	router := newRouter(store)
+	for _, target := range []string{
+		"/watch?folder=/w", "/watch?folder=/w&format=ndjson",
+		"/list?folder=/w", "/list?folder=/w&format=csv",
+	} {
+		t.Run(target, func(t *testing.T) {
+			expectError(t, request(router, "GET", target), http.StatusServiceUnavailable, CodeUnavailable)
+		})
+	}
+}
+
+func TestUnknownRoutesAreNotFound(t *testing.T) {
+	w := request(newRouter(newMemoryStore()), "GET", "/nope")
+	if apiErr := expectError(t, w, http.StatusNotFound, CodeNotFound); !strings.Contains(apiErr.Message, "/nope") {
+		t.Errorf("Responded %q, want the path named", apiErr.Message)
+	}
+}
+
+func TestOtherMethodsAreNotAllowed(t *testing.T) {
+	w := request(newRouter(newMemoryStore()), "POST", "/watch?folder=/w")
+	if apiErr := expectError(t, w, http.StatusMethodNotAllowed, CodeMethodNotAllowed); !strings.Contains(apiErr.Message, "POST") {
+		t.Errorf("Responded %q, want the method named", apiErr.Message)
+	}
+}
+
+func TestPanicsAreInternalErrors(t *testing.T) {
+	w := request(newRouter(newMemoryStore()), "GET", "/panic")
+	// the panic's detail is only logged
+	if apiErr := expectError(t, w, http.StatusInternalServerError, CodeInternal); apiErr.Message != "Internal server error" {
+		t.Errorf("Responded %q, want the detail kept back", apiErr.Message)
+	}
+}
+
+func TestListIsBoundedByPathSegments(t *testing.T) {
+	router := newRouter(newMemoryStore(testNodes()...))
+	for target, want := range map[string]string{
+		"/list?folder=/w":                        "/w/2019,/w/2019 old",
+		"/list?folder=/w/2019":                   "/w/2019/03,/w/2019/a.pdf",
+		"/list?folder=/w&recursive=true":         "/w/2019,/w/2019 old,/w/2019/03,/w/2019/03/b.pdf,/w/2019/a.pdf",
+		"/list?folder=/w&recursive=true&depth=2": "/w/2019,/w/2019 old,/w/2019/03,/w/2019/a.pdf",
+	} {
+		w := request(router, "GET", target)
+		var fsNodes []elasticSearch.FsNode
+		if err := json.Unmarshal(w.Body.Bytes(), &fsNodes); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s responded %d %s", target, w.Code, w.Body)
+		}
+		var paths []string
+		for _, fsNode := range fsNodes {
+			paths = append(paths, fsNode.FullPath)
+		}
+		if got := strings.Join(paths, ","); got != want {
+			t.Errorf("%s listed %s, want %s", target, got, want)
+		}
+	}
+}
+
+// slowStore - scrolls the nodes slower than the server's write timeout allows
+// for the whole listing
+type slowStore struct {
+	*memoryStore
+	delay time.Duration
+}
+
+func (s slowStore) ScrollFsNodes(ctx context.Context, folderPath string, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+	return s.memoryStore.ScrollFsNodes(ctx, folderPath, start, func(fsNode elasticSearch.FsNode) error {
+		time.Sleep(s.delay)
+		return each(fsNode)
+	})
+}
+
+func TestExportsOutlastTheWriteTimeout(t *testing.T) {
+	server := httptest.NewUnstartedServer(newRouter(slowStore{newMemoryStore(testNodes()...), 50 * time.Millisecond}))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/watch?folder=/w&format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("The export was cut off after %q %v", body, err)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != len(testNodes()) {
+		t.Errorf("Exported %d nodes, want %d", lines, len(testNodes()))
+	}
+}
+
+func TestOverlappingPrefixesListEachNodeOnce(t *testing.T) {
+	router := newRouter(newMemoryStore(testNodes()...))
+	// /w/2019 old is matched by the store as a prefix of /w/2019, & /w/2019/03
+	// is within it
+	office := &auth.Principal{Name: "office", Prefixes: []string{"/w/2019 old", "/w/2019/03", "/w/2019"}}
+	want := "/w/2019,/w/2019 old,/w/2019/03,/w/2019/03/b.pdf,/w/2019/a.pdf"
+	for _, target := range []string{"/all", "/all?format=ndjson", "/watch?folder=/w", "/watch?folder=/w&format=ndjson"} {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), office)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s responded %d %s", target, w.Code, w.Body)
+		}
+		var paths []string
+		if strings.Contains(target, "ndjson") {
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				var fsNode elasticSearch.FsNode
+				if err := json.Unmarshal([]byte(line), &fsNode); err != nil {
+					t.Fatalf("%s streamed %q %v", target, line, err)
+				}
+				paths = append(paths, fsNode.FullPath)
+			}
+		} else {
+			var fsNodes []elasticSearch.FsNode
+			if err := json.Unmarshal(w.Body.Bytes(), &fsNodes); err != nil {
+				t.Fatalf("%s responded %s %v", target, w.Body, err)
+			}
+			for _, fsNode := range fsNodes {
+				paths = append(paths, fsNode.FullPath)
+			}
+			if count := w.Header().Get("X-Total-Count"); count != "5" {
+				t.Errorf("%s counted %s, want 5", target, count)
+			}
+		}
+		if got := strings.Join(paths, ","); got != want {
+			t.Errorf("%s listed %s, want %s", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+)
+
+// Authenticate - router middleware requiring requests to be authenticated,
+// other than those to the public routes (by path template). The principal is
+// passed on in the request's context for the handlers to authorize against.
+// Requests LimitRate has already authenticated aren't authenticated again
+func Authenticate(authenticator *auth.Auth, public ...string) mux.MiddlewareFunc {
+	publicRoutes := map[string]bool{}
+	for _, route := range public {
+		publicRoutes[route] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil && publicRoutes[template] {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if auth.FromContext(r.Context()) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			principal, err := authenticator.Authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				WriteError(w, r, NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "%v", err))
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, principal))
+		})
+	}
+}
+
+// withPrincipal - the request, carrying the principal it's authenticated as
+func withPrincipal(r *http.Request, principal *auth.Principal) *http.Request {
+	ctx := auth.WithPrincipal(r.Context(), principal)
+	ctx = logging.WithLogger(ctx, logging.Ctx(ctx).With().Str("principal", principal.Name).Logger())
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/cache"
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+)
+
+// cachedStore - reads folder listings through the listing cache
+type cachedStore struct {
+	FsNodeStore
+	listings *cache.Listings
+}
+
+// CachedStore - the store, reading listings through the cache when it's
+// enabled
+func CachedStore(store FsNodeStore, listings *cache.Listings) FsNodeStore {
+	if !listings.Enabled() {
+		return store
+	}
+	return &cachedStore{FsNodeStore: store, listings: listings}
+}
+
+func (s *cachedStore) GetAllFsNodes(ctx context.Context) ([]elasticSearch.FsNode, int64, error) {
+	return s.get(cache.AllKey, func() ([]elasticSearch.FsNode, int64, error) {
+		return s.FsNodeStore.GetAllFsNodes(ctx)
+	})
+}
+
+func (s *cachedStore) GetFsNodesForWatchFolder(ctx context.Context, folderPath string) ([]elasticSearch.FsNode, int64, error) {
+	return s.get(folderPath, func() ([]elasticSearch.FsNode, int64, error) {
+		return s.FsNodeStore.GetFsNodesForWatchFolder(ctx, folderPath)
+	})
+}
+
+func (s *cachedStore) get(key string, read func() ([]elasticSearch.FsNode, int64, error)) ([]elasticSearch.FsNode, int64, error) {
+	if fsNodes, totalHits, ok := s.listings.Get(key); ok {
+		metrics.ListingCache.WithLabelValues("hit").Inc()
+		return fsNodes, totalHits, nil
+	}
+	metrics.ListingCache.WithLabelValues("miss").Inc()
+	// the version is taken first, so a change whilst reading stops the
+	// listing being cached
+	version := s.listings.Version()
+	fsNodes, totalHits, err := read()
+	if err != nil {
+		return nil, 0, err
+	}
+	s.listings.Put(key, version, fsNodes, totalHits)
+	return fsNodes, totalHits, nil
+}
+
+// notModified - sets the validators of the listing about to be read at the
+// version, & whether the caller already has it. Callers must revalidate, as
+// the listing can change at any time
+func notModified(w http.ResponseWriter, r *http.Request, version cache.Version, format string) bool {
+	// the listing depends on the request, the format it's in & who it's for
+	scope := r.URL.Path + "?" + r.URL.RawQuery + "|" + format
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		scope += "|" + principal.Name
+	}
+	etag := version.ETag(scope)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", version.Modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Add("Vary", "Accept")
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !version.Modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// etagMatches - whether any of the tags in an If-None-Match header match the
+// tag, compared weakly
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/recorder"
+)
+
+// the codes given in API error responses, alongside the status
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeTooLarge         = "request_too_large"
+	CodeRateLimited      = "rate_limited"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal"
+)
+
+// APIError - an error returned by the API, every error response has a body of
+// {"error": {...}} holding one
+type APIError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// NewAPIError - an API error with the status & code
+func NewAPIError(status int, code, format string, args ...interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *APIError {
+	return NewAPIError(http.StatusBadRequest, CodeBadRequest, format, args...)
+}
+
+func notFound(format string, args ...interface{}) *APIError {
+	return NewAPIError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+// WriteError - writes the error response. Errors from ElasticSearch are 503
+// whilst it can't be reached, or 404 for something that doesn't exist. Any
+// other error is a 500, whose detail is logged rather than returned
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr, ok := err.(*APIError)
+	switch {
+	case ok:
+		copied := *apiErr
+		apiErr = &copied
+	case elasticSearch.IsUnavailable(err):
+		apiErr = NewAPIError(http.StatusServiceUnavailable, CodeUnavailable, "ElasticSearch is unavailable, try again later")
+	case elasticSearch.IsNotFound(err):
+		apiErr = notFound("Not found")
+	default:
+		apiErr = NewAPIError(http.StatusInternalServerError, CodeInternal, "Internal server error")
+	}
+	apiErr.RequestID = logging.CorrelationID(r.Context())
+
+	logger := logging.Ctx(r.Context())
+	event := logger.Warn()
+	if apiErr.Status >= http.StatusInternalServerError {
+		event = logger.Error()
+	}
+	event.Err(err).Int("status", apiErr.Status).Str("code", apiErr.Code).Msg("Request failed")
+
+	js, marshalErr := json.Marshal(map[string]*APIError{"error": apiErr})
+	if marshalErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	w.Write(js)
+}
+
+// NotFound - responds to requests that don't match a route
+func NotFound() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, notFound("No such endpoint %s", r.URL.Path))
+	})
+}
+
+// MethodNotAllowed - responds to requests whose route doesn't accept the method
+func MethodNotAllowed() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, NewAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "%s isn't allowed on %s", r.Method, r.URL.Path))
+	})
+}
+
+// RecoverPanics - router middleware turning a panic in a handler into a 500,
+// rather than the connection being dropped, & logging it along with the stack
+func RecoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := recorder.New(w)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			logging.Ctx(r.Context()).Error().
+				Interface("panic", recovered).
+				Bytes("stack", debug.Stack()).
+				Msg("Recovered from a panic serving the request")
+			// too late to send an error if the response is under way
+			if !response.Started() {
+				WriteError(w, r, fmt.Errorf("Panic serving the request %v", recovered))
+			}
+		}()
+		next.ServeHTTP(response, r)
+	})
+}
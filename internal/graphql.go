@@ -0,0 +1,437 @@
+package internal
+
+import (
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	graphql "github.com/graph-gophers/graphql-go"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+//go:embed schema.graphql
+var graphSchema string
+
+const (
+	// maxGraphQLBytes - the largest query accepted
+	maxGraphQLBytes = 1 << 20
+	// maxGraphQLDepth - how deeply queries may nest, as each level of
+	// children is another scroll through the index
+	maxGraphQLDepth = 10
+	// maxGraphQLScrolls - how many times a query may scroll through the
+	// index, as the children of every node on a page are another scroll,
+	// which nesting would multiply beyond what the depth limit stops
+	maxGraphQLScrolls = 100
+	// maxPageSize - the most nodes a connection returns at once
+	maxPageSize = 1000
+)
+
+// errPageFull - stops scrolling once a page has been filled
+var errPageFull = errors.New("Page full")
+
+// scrollsKey - the context key of how many scrolls a query has taken
+type scrollsKey struct{}
+
+// graphQLRequest - the body of a GraphQL request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// PostGraphQL executes GraphQL queries against the file index, see
+// schema.graphql. Errors executing the query are returned alongside the data
+// as GraphQL expects, only a request that isn't a query is an API error
+func PostGraphQL(store FsNodeStore) http.Handler {
+	schema := graphql.MustParseSchema(graphSchema, &graphResolver{store: store}, graphql.MaxDepth(maxGraphQLDepth))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		request := graphQLRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLBytes)).Decode(&request); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				WriteError(w, r, bodyReadError(err))
+				return
+			}
+			WriteError(w, r, badRequest("The request body isn't a GraphQL request %v", err))
+			return
+		}
+		if strings.TrimSpace(request.Query) == "" {
+			WriteError(w, r, badRequest("The request doesn't contain a query"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), scrollsKey{}, new(int32))
+		response := schema.Exec(ctx, request.Query, request.OperationName, request.Variables)
+		js, err := json.Marshal(response)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		w.Write(js)
+	})
+}
+
+// graphResolver - resolves the queries in the schema
+type graphResolver struct {
+	store FsNodeStore
+}
+
+// Node - the node at the path
+func (g *graphResolver) Node(ctx context.Context, args struct{ Path string }) (*fsNodeResolver, error) {
+	fsNode, err := lookupNode(ctx, g.store, args.Path)
+	if fsNode == nil || err != nil {
+		return nil, err
+	}
+	return &fsNodeResolver{graph: g, fsNode: *fsNode}, nil
+}
+
+// lookupNode - the node at the path, trying it as a folder then as a file.
+// nil when there's none, or the principal can't see it
+func lookupNode(ctx context.Context, store FsNodeStore, fullPath string) (*elasticSearch.FsNode, error) {
+	fullPath = path.Clean(fullPath)
+	if !auth.FromContext(ctx).Allows(fullPath) {
+		return nil, nil
+	}
+	for _, isDir := range []string{"true", "false"} {
+		fsNode, err := store.Get(ctx, generateUniqueID(fullPath, isDir))
+		if elasticSearch.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &fsNode, nil
+	}
+	return nil, nil
+}
+
+// Children - the nodes directly within the folder
+func (g *graphResolver) Children(ctx context.Context, args struct {
+	Path  string
+	First int32
+	After *string
+}) (*fsNodeConnection, error) {
+	return g.connection(ctx, g.childrenQuery(ctx, path.Clean(args.Path)), args.First, args.After)
+}
+
+// Search - the nodes whose name contains the text, within the folder if given
+func (g *graphResolver) Search(ctx context.Context, args struct {
+	Text   string
+	Folder *string
+	First  int32
+	After  *string
+}) (*fsNodeConnection, error) {
+	folder := ""
+	if args.Folder != nil {
+		folder = *args.Folder
+	}
+	return g.connection(ctx, searchQuery(ctx, g.store, folder, args.Text), args.First, args.After)
+}
+
+// searchQuery - the nodes within the folder, every node when it's empty,
+// whose name contains the text, ignoring case
+func searchQuery(ctx context.Context, store FsNodeStore, folder, text string) *nodeQuery {
+	if folder != "" {
+		folder = path.Clean(folder)
+	}
+	text = strings.ToLower(text)
+	return &nodeQuery{
+		store:   store,
+		folders: visibleFolders(auth.FromContext(ctx), folder),
+		match: func(fsNode elasticSearch.FsNode) bool {
+			return withinFolder(fsNode.FullPath, folder) && strings.Contains(strings.ToLower(fsNode.Name), text)
+		},
+	}
+}
+
+// WatchFolders - the folders being watched
+func (g *graphResolver) WatchFolders(ctx context.Context, args struct {
+	First int32
+	After *string
+}) (*fsNodeConnection, error) {
+	return g.connection(ctx, &nodeQuery{
+		store:   g.store,
+		folders: visibleFolders(auth.FromContext(ctx), ""),
+		match: func(fsNode elasticSearch.FsNode) bool {
+			return fsNode.IsWatchFolder
+		},
+	}, args.First, args.After)
+}
+
+// childrenQuery - the nodes whose parent is the folder, listed a level deep
+// so the rest of the subtree isn't scrolled
+func (g *graphResolver) childrenQuery(ctx context.Context, folder string) *nodeQuery {
+	query := &nodeQuery{
+		store: g.store,
+		depth: 1,
+		match: func(elasticSearch.FsNode) bool { return true },
+	}
+	// there's no listing a folder the principal can't see anything within
+	if len(visibleFolders(auth.FromContext(ctx), folder)) > 0 {
+		query.folders = []string{folder}
+	}
+	return query
+}
+
+// connection - the page of the query's nodes asked for
+func (g *graphResolver) connection(ctx context.Context, query *nodeQuery, first int32, after *string) (*fsNodeConnection, error) {
+	size := int(first)
+	if size < 0 || size > maxPageSize {
+		return nil, fmt.Errorf("First must be between 0 & %d", maxPageSize)
+	}
+	afterPath := ""
+	if after != nil {
+		var err error
+		if afterPath, err = decodeCursor(*after); err != nil {
+			return nil, err
+		}
+	}
+	fsNodes, more, err := query.page(ctx, size, afterPath)
+	if err != nil {
+		return nil, err
+	}
+	return &fsNodeConnection{graph: g, query: query, fsNodes: fsNodes, more: more}, nil
+}
+
+// visibleFolders - the folders to scroll for the nodes within the folder, an
+// empty folder being every node, that the principal may see. None is within
+// another
+func visibleFolders(principal *auth.Principal, folder string) []string {
+	if principal.Unrestricted() {
+		return []string{folder}
+	}
+	if folder == "" || folder == "/" {
+		return outermostFolders(principal.Prefixes)
+	}
+	folders, err := authorizedFolders(principal, folder)
+	if err != nil {
+		// there's nothing they may see there
+		return nil
+	}
+	return outermostFolders(folders)
+}
+
+// withinFolder - whether the path is the folder or beneath it, an empty
+// folder being everywhere. Unlike the store's prefix matching, /x/2019 isn't
+// within /x/20
+func withinFolder(fullPath, folder string) bool {
+	return folder == "" || fullPath == folder || strings.HasPrefix(fullPath, strings.TrimSuffix(folder, "/")+"/")
+}
+
+// parentPath - the path of the folder the path is in
+func parentPath(fullPath string) string {
+	return path.Dir(fullPath)
+}
+
+// nodeQuery - the nodes in the folders that match, ordered by path. They're
+// scrolled from the store each time they're needed, so memory use is bounded
+// by the page size rather than the size of the index. With a depth the
+// folders are listed down to it, otherwise every node they prefix is
+// scrolled, or across several folders only those within them
+type nodeQuery struct {
+	store   FsNodeStore
+	folders []string
+	depth   int
+	match   func(elasticSearch.FsNode) bool
+}
+
+// scroll - calls each with the matching nodes the principal may see
+func (q *nodeQuery) scroll(ctx context.Context, each func(elasticSearch.FsNode) error) error {
+	principal := auth.FromContext(ctx)
+	matching := func(fsNode elasticSearch.FsNode) error {
+		if !principal.Allows(fsNode.FullPath) || !q.match(fsNode) {
+			return nil
+		}
+		return each(fsNode)
+	}
+	folders := outermostFolders(q.folders)
+	if q.depth == 0 && len(folders) > 1 {
+		// the nodes are paged by path, so must come in path order across
+		// the folders
+		for range folders {
+			if err := countScroll(ctx); err != nil {
+				return err
+			}
+		}
+		return scrollWithin(ctx, q.store, folders, matching)
+	}
+	for _, folder := range folders {
+		if err := countScroll(ctx); err != nil {
+			return err
+		}
+		var err error
+		if q.depth > 0 {
+			err = q.store.ListFsNodes(ctx, folder, q.depth, func(int64) {}, matching)
+		} else {
+			err = q.store.ScrollFsNodes(ctx, folder, func(int64) {}, matching)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countScroll - counts another scroll towards the query's limit, refusing it
+// once the limit's reached. Fields are resolved in parallel, so the count is
+// shared
+func countScroll(ctx context.Context) error {
+	scrolls, ok := ctx.Value(scrollsKey{}).(*int32)
+	if ok && atomic.AddInt32(scrolls, 1) > maxGraphQLScrolls {
+		return fmt.Errorf("The query needs more than %d scrolls through the index, ask for fewer nodes' children", maxGraphQLScrolls)
+	}
+	return nil
+}
+
+// page - up to size nodes after the path, & whether there are more
+func (q *nodeQuery) page(ctx context.Context, size int, after string) ([]elasticSearch.FsNode, bool, error) {
+	fsNodes := []elasticSearch.FsNode{}
+	more := false
+	err := q.scroll(ctx, func(fsNode elasticSearch.FsNode) error {
+		if after != "" && fsNode.FullPath <= after {
+			return nil
+		}
+		if len(fsNodes) == size {
+			more = true
+			return errPageFull
+		}
+		fsNodes = append(fsNodes, fsNode)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return nil, false, err
+	}
+	return fsNodes, more, nil
+}
+
+// fsNodeResolver - resolves an FsNode's fields
+type fsNodeResolver struct {
+	graph  *graphResolver
+	fsNode elasticSearch.FsNode
+}
+
+func (n *fsNodeResolver) Name() string        { return n.fsNode.Name }
+func (n *fsNodeResolver) FullPath() string    { return n.fsNode.FullPath }
+func (n *fsNodeResolver) IsDir() bool         { return n.fsNode.IsDir }
+func (n *fsNodeResolver) IsWatchFolder() bool { return n.fsNode.IsWatchFolder }
+func (n *fsNodeResolver) ParentPath() string  { return parentPath(n.fsNode.FullPath) }
+
+// Parent - the folder the node is in, there's none above the watch folder
+func (n *fsNodeResolver) Parent(ctx context.Context) (*fsNodeResolver, error) {
+	if n.fsNode.IsWatchFolder {
+		return nil, nil
+	}
+	return n.graph.Node(ctx, struct{ Path string }{Path: parentPath(n.fsNode.FullPath)})
+}
+
+// Ancestors - the folders the node is within, outermost first. Those that
+// aren't in the index, such as above the watch folder, are left out
+func (n *fsNodeResolver) Ancestors(ctx context.Context) ([]*fsNodeResolver, error) {
+	ancestors := []*fsNodeResolver{}
+	for folder := parentPath(n.fsNode.FullPath); folder != "/" && folder != "."; folder = parentPath(folder) {
+		ancestor, err := n.graph.Node(ctx, struct{ Path string }{Path: folder})
+		if err != nil {
+			return nil, err
+		}
+		if ancestor != nil {
+			ancestors = append([]*fsNodeResolver{ancestor}, ancestors...)
+		}
+	}
+	return ancestors, nil
+}
+
+// Children - the nodes directly within the folder, none for a file
+func (n *fsNodeResolver) Children(ctx context.Context, args struct {
+	First int32
+	After *string
+}) (*fsNodeConnection, error) {
+	if !n.fsNode.IsDir {
+		return &fsNodeConnection{graph: n.graph, query: &nodeQuery{}, fsNodes: []elasticSearch.FsNode{}}, nil
+	}
+	return n.graph.connection(ctx, n.graph.childrenQuery(ctx, n.fsNode.FullPath), args.First, args.After)
+}
+
+// fsNodeConnection - a page of a query's nodes
+type fsNodeConnection struct {
+	graph   *graphResolver
+	query   *nodeQuery
+	fsNodes []elasticSearch.FsNode
+	more    bool
+}
+
+// TotalCount - how many nodes the query has across every page, which takes
+// another scroll through them so is only counted when asked for
+func (c *fsNodeConnection) TotalCount(ctx context.Context) (int32, error) {
+	var count int32
+	err := c.query.scroll(ctx, func(elasticSearch.FsNode) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (c *fsNodeConnection) Edges() []*fsNodeEdge {
+	edges := make([]*fsNodeEdge, len(c.fsNodes))
+	for i, fsNode := range c.fsNodes {
+		edges[i] = &fsNodeEdge{node: &fsNodeResolver{graph: c.graph, fsNode: fsNode}}
+	}
+	return edges
+}
+
+func (c *fsNodeConnection) Nodes() []*fsNodeResolver {
+	nodes := make([]*fsNodeResolver, len(c.fsNodes))
+	for i, fsNode := range c.fsNodes {
+		nodes[i] = &fsNodeResolver{graph: c.graph, fsNode: fsNode}
+	}
+	return nodes
+}
+
+func (c *fsNodeConnection) PageInfo() *pageInfo {
+	info := &pageInfo{hasNextPage: c.more}
+	if len(c.fsNodes) > 0 {
+		cursor := cursorFor(c.fsNodes[len(c.fsNodes)-1])
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+type fsNodeEdge struct {
+	node *fsNodeResolver
+}
+
+func (e *fsNodeEdge) Cursor() string        { return cursorFor(e.node.fsNode) }
+func (e *fsNodeEdge) Node() *fsNodeResolver { return e.node }
+
+type pageInfo struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (p *pageInfo) HasNextPage() bool  { return p.hasNextPage }
+func (p *pageInfo) EndCursor() *string { return p.endCursor }
+
+// cursorFor - the cursor after the node, its path as the nodes are ordered by
+// path
+func cursorFor(fsNode elasticSearch.FsNode) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fsNode.FullPath))
+}
+
+// decodeCursor - the path the cursor is after, empty for no cursor
+func decodeCursor(cursor string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("Invalid cursor %q", cursor)
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+)
+
+// countingStore - counts the scrolls through the store, by how they're made
+type countingStore struct {
+	*memoryStore
+	scrolls, lists int
+}
+
+func (s *countingStore) ScrollFsNodes(ctx context.Context, folderPath string, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+	s.scrolls++
+	return s.memoryStore.ScrollFsNodes(ctx, folderPath, start, each)
+}
+
+func (s *countingStore) ListFsNodes(ctx context.Context, folderPath string, depth int, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+	s.lists++
+	return s.memoryStore.ListFsNodes(ctx, folderPath, depth, start, each)
+}
+
+// graphQLResponse - the data & errors a query returned
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// query - executes the query as the principal, nil being unauthenticated
+func query(t *testing.T, store FsNodeStore, principal *auth.Principal, graphQL string) graphQLResponse {
+	t.Helper()
+	body, err := json.Marshal(graphQLRequest{Query: graphQL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/graphql", strings.NewReader(string(body)))
+	if principal != nil {
+		r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+	}
+	w := httptest.NewRecorder()
+	PostGraphQL(store).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Responded %d %s", w.Code, w.Body)
+	}
+	var response graphQLResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// childPaths - the paths of the children in the data of a children query
+func childPaths(t *testing.T, response graphQLResponse) string {
+	t.Helper()
+	if len(response.Errors) > 0 {
+		t.Fatalf("Errors %+v", response.Errors)
+	}
+	var data struct {
+		Children struct {
+			Nodes []struct{ FullPath string }
+		}
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, node := range data.Children.Nodes {
+		paths = append(paths, node.FullPath)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestChildrenAreListedALevelDeep(t *testing.T) {
+	store := &countingStore{memoryStore: newMemoryStore(testNodes()...)}
+	response := query(t, store, nil, `{ children(path: "/w") { nodes { fullPath } } }`)
+	if got := childPaths(t, response); got != "/w/2019,/w/2019 old" {
+		t.Errorf("Listed %s, want /w/2019,/w/2019 old", got)
+	}
+	if store.scrolls != 0 || store.lists != 1 {
+		t.Errorf("Scrolled %d times & listed %d, want a single listing", store.scrolls, store.lists)
+	}
+
+	response = query(t, store, nil, `{ node(path: "/w/2019") { children { nodes { fullPath children { nodes { fullPath } } } } } }`)
+	if len(response.Errors) > 0 || !strings.Contains(string(response.Data), "/w/2019/03/b.pdf") {
+		t.Errorf("Responded %s %+v, want the grandchildren", response.Data, response.Errors)
+	}
+}
+
+func TestChildrenAreThoseThePrincipalMaySee(t *testing.T) {
+	store := newMemoryStore(testNodes()...)
+	office := &auth.Principal{Name: "office", Prefixes: []string{"/w/2019"}}
+	if got := childPaths(t, query(t, store, office, `{ children(path: "/w") { nodes { fullPath } } }`)); got != "/w/2019" {
+		t.Errorf("Listed %s, want /w/2019", got)
+	}
+	nobody := &auth.Principal{Name: "nobody", Prefixes: []string{"/x"}}
+	if got := childPaths(t, query(t, store, nobody, `{ children(path: "/w") { nodes { fullPath } } }`)); got != "" {
+		t.Errorf("Listed %s, want nothing", got)
+	}
+}
+
+func TestQueriesScrollingTooOftenAreRefused(t *testing.T) {
+	fsNodes := []elasticSearch.FsNode{{Name: "w", FullPath: "/w", IsDir: true, IsWatchFolder: true}}
+	for i := 0; i < maxGraphQLScrolls; i++ {
+		name := fmt.Sprintf("%03d", i)
+		fsNodes = append(fsNodes, elasticSearch.FsNode{Name: name, FullPath: "/w/" + name, IsDir: true})
+	}
+	store := &countingStore{memoryStore: newMemoryStore(fsNodes...)}
+
+	// the listing of /w, then one of each of its folders
+	response := query(t, store, nil, `{ children(path: "/w", first: 1000) { nodes { children(first: 1) { totalCount } } } }`)
+	if len(response.Errors) == 0 || !strings.Contains(response.Errors[0].Message, "scrolls through the index") {
+		t.Errorf("Responded %+v, want the query refused", response.Errors)
+	}
+	if store.lists > maxGraphQLScrolls {
+		t.Errorf("Listed %d times, want at most %d", store.lists, maxGraphQLScrolls)
+	}
+
+	if response := query(t, store, nil, `{ children(path: "/w", first: 10) { nodes { children(first: 1) { totalCount } } } }`); len(response.Errors) > 0 {
+		t.Errorf("A smaller query was refused %+v", response.Errors)
+	}
+}
+
+// pagePaths - the paths of every node of the connection, paged through two
+// at a time. field opens the connection's arguments, e.g. `search(text: "x"`
+func pagePaths(t *testing.T, store FsNodeStore, principal *auth.Principal, field string) string {
+	t.Helper()
+	var paths []string
+	after := ""
+	for page := 0; page < 10; page++ {
+		response := query(t, store, principal, fmt.Sprintf(`{ connection: %s first: 2%s) { nodes { fullPath } pageInfo { hasNextPage endCursor } } }`, field, after))
+		if len(response.Errors) > 0 {
+			t.Fatalf("%s responded %+v", field, response.Errors)
+		}
+		var data struct {
+			Connection struct {
+				Nodes    []struct{ FullPath string }
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range data.Connection.Nodes {
+			paths = append(paths, node.FullPath)
+		}
+		if !data.Connection.PageInfo.HasNextPage {
+			break
+		}
+		after = fmt.Sprintf(`, after: %q`, data.Connection.PageInfo.EndCursor)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestPagesAcrossOverlappingPrefixesAreInPathOrder(t *testing.T) {
+	fsNodes := testNodes()
+	// each folder's watched on its own
+	for i := range fsNodes {
+		fsNodes[i].IsWatchFolder = fsNodes[i].IsDir
+	}
+	store := newMemoryStore(fsNodes...)
+	// /w/2019 old is matched by the store as a prefix of /w/2019, & /w/2019/03
+	// is within it
+	office := &auth.Principal{Name: "office", Prefixes: []string{"/w/2019 old", "/w/2019/03", "/w/2019"}}
+	for field, want := range map[string]string{
+		`search(text: "",`:          "/w/2019,/w/2019 old,/w/2019/03,/w/2019/03/b.pdf,/w/2019/a.pdf",
+		`search(text: "2019",`:      "/w/2019,/w/2019 old",
+		`watchFolders(`:             "/w/2019,/w/2019 old,/w/2019/03",
+		`children(path: "/w/2019",`: "/w/2019/03,/w/2019/a.pdf",
+	} {
+		if got := pagePaths(t, store, office, field); got != want {
+			t.Errorf("%s paged through %s, want %s", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/changes"
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/rpc"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultPageSize - the nodes a search returns at once, when the caller
+	// doesn't say
+	defaultPageSize = 100
+	// changeBuffer - how many changes a watcher may fall behind by before
+	// it's dropped
+	changeBuffer = 256
+	// reflectionPrefix - the methods of the reflection service, which are
+	// open like the API's docs
+	reflectionPrefix = "/grpc.reflection."
+)
+
+// the folder watch actions, as changes are sent to watchers
+var changeActions = map[string]rpc.Change_Action{
+	rabbitMQ.CreateAction: rpc.Change_CREATE,
+	rabbitMQ.DeleteAction: rpc.Change_DELETE,
+	rabbitMQ.RenameAction: rpc.Change_RENAME,
+	rabbitMQ.MoveAction:   rpc.Change_MOVE,
+}
+
+// the gRPC codes API errors are sent as, any other status being Internal
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:         codes.InvalidArgument,
+	http.StatusUnauthorized:       codes.Unauthenticated,
+	http.StatusForbidden:          codes.PermissionDenied,
+	http.StatusNotFound:           codes.NotFound,
+	http.StatusTooManyRequests:    codes.ResourceExhausted,
+	http.StatusServiceUnavailable: codes.Unavailable,
+}
+
+// NewGRPCServer - serves the file index over gRPC, see rpc/fsnode.proto.
+// Calls are logged, traced, timed & authenticated like REST API requests,
+// other than reflection's, which lets tools such as grpcurl discover the
+// service when it's enabled. Calls are logged to the logger
+func NewGRPCServer(store FsNodeStore, feed *changes.Feed, authenticator *auth.Auth, withReflection bool, logger zerolog.Logger, options ...grpc.ServerOption) *grpc.Server {
+	options = append(options,
+		grpc.ChainUnaryInterceptor(unaryInterceptor(authenticator, logger)),
+		grpc.ChainStreamInterceptor(streamInterceptor(authenticator, logger)))
+	server := grpc.NewServer(options...)
+	rpc.RegisterFsNodesServer(server, &fsNodesServer{store: store, feed: feed})
+	if withReflection {
+		reflection.Register(server)
+	}
+	return server
+}
+
+func unaryInterceptor(authenticator *auth.Auth, logger zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response interface{}, err error) {
+		err = serveCall(logging.WithLogger(ctx, logger), info.FullMethod, authenticator, func(ctx context.Context) error {
+			var err error
+			response, err = handler(ctx, request)
+			return err
+		})
+		return response, err
+	}
+}
+
+func streamInterceptor(authenticator *auth.Auth, logger zerolog.Logger) grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return serveCall(logging.WithLogger(stream.Context(), logger), info.FullMethod, authenticator, func(ctx context.Context) error {
+			return handler(server, &contextStream{ServerStream: stream, ctx: ctx})
+		})
+	}
+}
+
+// contextStream - a stream whose handler is given a different context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// serveCall - makes the call with a correlation ID, from its x-request-id or
+// x-correlation-id metadata, which is returned in the x-request-id header,
+// continuing any trace propagated by the caller. Unless it's to the
+// reflection service, the call must be authenticated when there's an
+// authenticator. Once served the call is logged & timed, with a panic being
+// recovered from as an Internal error
+func serveCall(ctx context.Context, method string, authenticator *auth.Auth, call func(context.Context) error) (err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	id := header(logging.RequestIDHeader)
+	if id == "" {
+		id = header(logging.CorrelationHeader)
+	}
+	ctx = logging.WithCorrelationID(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDHeader, logging.CorrelationID(ctx)))
+
+	propagated := map[string]string{}
+	for name := range md {
+		propagated[name] = header(name)
+	}
+	ctx, span := tracer.Start(tracing.Extract(ctx, propagated), method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+		))
+
+	started := time.Now()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logging.Ctx(ctx).Error().
+				Interface("panic", recovered).
+				Bytes("stack", debug.Stack()).
+				Msg("Recovered from a panic serving the call")
+			err = status.Error(codes.Internal, "Internal server error")
+		}
+		code := status.Code(err)
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", code.String()))
+		tracing.End(span, err)
+		metrics.GRPCRequests.WithLabelValues(method, code.String()).Observe(time.Since(started).Seconds())
+		logging.Ctx(ctx).Info().
+			Str("method", method).
+			Str("code", code.String()).
+			Dur("took", time.Since(started)).
+			Msg("Served call")
+	}()
+
+	if authenticator != nil && !strings.HasPrefix(method, reflectionPrefix) {
+		var state *tls.ConnectionState
+		if caller, ok := peer.FromContext(ctx); ok {
+			if info, ok := caller.AuthInfo.(credentials.TLSInfo); ok {
+				state = &info.State
+			}
+		}
+		principal, err := authenticator.AuthenticateHeaders(state, header)
+		if err != nil {
+			logging.Ctx(ctx).Warn().Err(err).Str("method", method).Msg("Call failed")
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = auth.WithPrincipal(ctx, principal)
+		ctx = logging.WithLogger(ctx, logging.Ctx(ctx).With().Str("principal", principal.Name).Logger())
+	}
+	return grpcError(ctx, call(ctx))
+}
+
+// grpcError - the error as a gRPC status, as WriteError would respond with
+// it. Any other error is Internal, whose detail is logged rather than
+// returned
+func grpcError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		// it's nil, or already a status
+		return err
+	}
+	var apiErr *APIError
+	var result *status.Status
+	switch {
+	case errors.As(err, &apiErr):
+		code, ok := grpcCodes[apiErr.Status]
+		if !ok {
+			code = codes.Internal
+		}
+		result = status.New(code, apiErr.Message)
+	case errors.Is(err, context.Canceled):
+		result = status.New(codes.Canceled, "The call was cancelled")
+	case errors.Is(err, context.DeadlineExceeded):
+		result = status.New(codes.DeadlineExceeded, "The call's deadline was exceeded")
+	case elasticSearch.IsUnavailable(err):
+		result = status.New(codes.Unavailable, "ElasticSearch is unavailable, try again later")
+	case elasticSearch.IsNotFound(err):
+		result = status.New(codes.NotFound, "Not found")
+	default:
+		result = status.New(codes.Internal, "Internal server error")
+	}
+
+	if result.Code() == codes.Canceled {
+		// the caller hung up, which is how watching ends
+		return result.Err()
+	}
+	logger := logging.Ctx(ctx)
+	event := logger.Warn()
+	if result.Code() == codes.Internal || result.Code() == codes.Unavailable {
+		event = logger.Error()
+	}
+	event.Err(err).Str("code", result.Code().String()).Msg("Call failed")
+	return result.Err()
+}
+
+// fsNodesServer - serves the FsNodes service. Like the REST API, only the
+// nodes the caller may see are returned
+type fsNodesServer struct {
+	rpc.UnimplementedFsNodesServer
+	store FsNodeStore
+	feed  *changes.Feed
+}
+
+// ListNodes - streams the nodes within the folder, or every node, as they're
+// scrolled from the store
+func (s *fsNodesServer) ListNodes(request *rpc.ListNodesRequest, stream rpc.FsNodes_ListNodesServer) error {
+	ctx := stream.Context()
+	folders := visibleFolders(auth.FromContext(ctx), "")
+	folder := ""
+	if request.Folder != "" {
+		folder = path.Clean(request.Folder)
+		var err error
+		if folders, err = authorizedFolders(auth.FromContext(ctx), folder); err != nil {
+			return err
+		}
+		sort.Strings(folders)
+	}
+	query := &nodeQuery{
+		store:   s.store,
+		folders: folders,
+		match: func(fsNode elasticSearch.FsNode) bool {
+			return withinFolder(fsNode.FullPath, folder)
+		},
+	}
+	return query.scroll(ctx, func(fsNode elasticSearch.FsNode) error {
+		return stream.Send(fsNodeMessage(fsNode))
+	})
+}
+
+// GetNode - the node at the path, trying it as a folder then as a file
+func (s *fsNodesServer) GetNode(ctx context.Context, request *rpc.GetNodeRequest) (*rpc.FsNode, error) {
+	if request.Path == "" {
+		return nil, status.Error(codes.InvalidArgument, "The path of the node is required")
+	}
+	fsNode, err := lookupNode(ctx, s.store, request.Path)
+	if err != nil {
+		return nil, err
+	}
+	if fsNode == nil {
+		return nil, status.Errorf(codes.NotFound, "There's nothing at %s", request.Path)
+	}
+	return fsNodeMessage(*fsNode), nil
+}
+
+// Search - a page of the nodes whose name contains the text
+func (s *fsNodesServer) Search(ctx context.Context, request *rpc.SearchRequest) (*rpc.SearchResponse, error) {
+	if strings.TrimSpace(request.Text) == "" {
+		return nil, status.Error(codes.InvalidArgument, "The text to search for is required")
+	}
+	size := int(request.PageSize)
+	if size == 0 {
+		size = defaultPageSize
+	}
+	if size < 0 || size > maxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "The page size must be between 1 & %d", maxPageSize)
+	}
+	after, err := decodeCursor(request.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fsNodes, more, err := searchQuery(ctx, s.store, request.Folder, request.Text).page(ctx, size, after)
+	if err != nil {
+		return nil, err
+	}
+	response := &rpc.SearchResponse{Nodes: make([]*rpc.FsNode, len(fsNodes))}
+	for i, fsNode := range fsNodes {
+		response.Nodes[i] = fsNodeMessage(fsNode)
+	}
+	if more {
+		response.NextPageToken = cursorFor(fsNodes[len(fsNodes)-1])
+	}
+	return response, nil
+}
+
+// WatchChanges - streams the changes applied to the index from now on, until
+// the caller cancels or falls too far behind
+func (s *fsNodesServer) WatchChanges(request *rpc.WatchChangesRequest, stream rpc.FsNodes_WatchChangesServer) error {
+	ctx := stream.Context()
+	principal := auth.FromContext(ctx)
+	folder := ""
+	if request.Folder != "" {
+		folder = path.Clean(request.Folder)
+		if _, err := authorizedFolders(principal, folder); err != nil {
+			return err
+		}
+	}
+
+	subscription := s.feed.Subscribe(changeBuffer)
+	defer subscription.Close()
+	// the headers are sent straight away, so the caller knows it's watching
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change, ok := <-subscription.C:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "Fell too far behind the changes, list the nodes again & watch from then")
+			}
+			message := changeMessage(change, principal, folder)
+			if message == nil {
+				continue
+			}
+			if err := stream.Send(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func fsNodeMessage(fsNode elasticSearch.FsNode) *rpc.FsNode {
+	return &rpc.FsNode{
+		Name:          fsNode.Name,
+		FullPath:      fsNode.FullPath,
+		IsDir:         fsNode.IsDir,
+		IsWatchFolder: fsNode.IsWatchFolder,
+	}
+}
+
+// changeMessage - the change as a message, leaving out the paths the
+// principal can't see or that aren't within the folder. nil when that's all
+// of them
+func changeMessage(change changes.Change, principal *auth.Principal, folder string) *rpc.Change {
+	visible := func(fullPath string) bool {
+		return fullPath != "" && withinFolder(fullPath, folder) && principal.Allows(fullPath)
+	}
+	message := &rpc.Change{
+		Action: changeActions[change.Action],
+		IsDir:  change.IsDir,
+		Time:   timestamppb.New(change.Time),
+	}
+	if visible(change.Path) {
+		message.Path = change.Path
+	}
+	if visible(change.OldPath) {
+		message.OldPath = change.OldPath
+	}
+	if message.Path == "" && message.OldPath == "" {
+		return nil
+	}
+	if principal.Allows(change.WatchFolder) {
+		message.WatchFolder = change.WatchFolder
+	}
+	return message
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/rpc"
+	"google.golang.org/grpc"
+)
+
+// listStream - collects the nodes ListNodes sends
+type listStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	paths []string
+}
+
+func (l *listStream) Context() context.Context { return l.ctx }
+
+func (l *listStream) Send(fsNode *rpc.FsNode) error {
+	l.paths = append(l.paths, fsNode.FullPath)
+	return nil
+}
+
+func TestNestedPrefixesAreListedOnceOverGRPC(t *testing.T) {
+	server := &fsNodesServer{store: newMemoryStore(testNodes()...)}
+	// /w/2019 old is matched by the store as a prefix of /w/2019, & /w/2019/03
+	// is within it
+	office := &auth.Principal{Name: "office", Prefixes: []string{"/w/2019 old", "/w/2019/03", "/w/2019"}}
+	ctx := auth.WithPrincipal(context.Background(), office)
+	want := "/w/2019,/w/2019 old,/w/2019/03,/w/2019/03/b.pdf,/w/2019/a.pdf"
+
+	for _, folder := range []string{"", "/w"} {
+		stream := &listStream{ctx: ctx}
+		if err := server.ListNodes(&rpc.ListNodesRequest{Folder: folder}, stream); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(stream.paths, ","); got != want {
+			t.Errorf("Listing %q streamed %s, want %s", folder, got, want)
+		}
+	}
+
+	var paths []string
+	request := &rpc.SearchRequest{Text: "0", PageSize: 2}
+	for page := 0; page < 10; page++ {
+		response, err := server.Search(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fsNode := range response.Nodes {
+			paths = append(paths, fsNode.FullPath)
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		request.PageToken = response.NextPageToken
+	}
+	if got := strings.Join(paths, ","); got != "/w/2019,/w/2019 old,/w/2019/03" {
+		t.Errorf("Searching paged through %s, want /w/2019,/w/2019 old,/w/2019/03", got)
+	}
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/consumer"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+)
+
+const (
+	// IngestRoutingKey - the routing key messages posted to the API are
+	// published with on the in-process source
+	IngestRoutingKey = "ingest"
+
+	// maxIngestBytes - the largest request body accepted
+	maxIngestBytes = 10 << 20
+	// ingestRetention - how long the results of an async request are kept once
+	// it's complete
+	ingestRetention = time.Hour
+)
+
+// IngestResult - the outcome of processing one message of an ingest request
+type IngestResult struct {
+	Index  int    `json:"index"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Action string `json:"action,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// IngestBatch - an ingest request, & the results of processing its messages
+type IngestBatch struct {
+	ID        string         `json:"id,omitempty"`
+	Complete  bool           `json:"complete"`
+	Received  time.Time      `json:"received"`
+	Completed *time.Time     `json:"completed,omitempty"`
+	Processed int            `json:"processed"`
+	Failed    int            `json:"failed"`
+	Results   []IngestResult `json:"results"`
+}
+
+// Ingester - publishes messages posted to the API onto the in-process source,
+// so they're run through the same handler pipeline as those from the broker.
+// Async requests are tracked by ID until a while after they've completed
+type Ingester struct {
+	source *consumer.Channel
+	tokens []string
+
+	mu      sync.Mutex
+	batches map[string]*IngestBatch
+}
+
+// NewIngester - creates an ingester publishing to the source. Requests must
+// carry one of the tokens as a bearer token
+func NewIngester(source *consumer.Channel, tokens []string) *Ingester {
+	return &Ingester{
+		source:  source,
+		tokens:  tokens,
+		batches: map[string]*IngestBatch{},
+	}
+}
+
+// PostIngest accepts a single folder watch message, a JSON array of them, or
+// newline delimited JSON, and processes them in order. The per message results
+// are returned once they've all been processed, unless async=true is given in
+// which case it responds 202 with the ID to look the results up by
+func PostIngest(ingester *Ingester) http.Handler {
+	return ingester.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		messages, err := readIngestMessages(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		batch := &IngestBatch{Received: time.Now(), Results: make([]IngestResult, len(messages))}
+		if r.URL.Query().Get("async") != "true" {
+			ingester.process(r.Context(), batch, messages)
+			writeIngestBatch(w, r, http.StatusOK, batch)
+			return
+		}
+
+		id, err := newTrackingID()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		batch.ID = id
+		ingester.track(batch)
+		// processing outlives the request, but is still part of its trace
+		ctx := trace.ContextWithSpanContext(logging.Detach(r.Context()), trace.SpanContextFromContext(r.Context()))
+		go ingester.process(ctx, batch, messages)
+
+		w.Header().Set("Location", "/events/ingest/"+id)
+		js, err := json.Marshal(map[string]string{"id": id})
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+	}))
+}
+
+// GetIngest returns the progress & results of an async ingest request
+func GetIngest(ingester *Ingester) http.Handler {
+	return ingester.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponseHeader(w)
+
+		batch, ok := ingester.lookup(mux.Vars(r)["id"])
+		if !ok {
+			WriteError(w, r, notFound("No ingest request with that ID"))
+			return
+		}
+		writeIngestBatch(w, r, http.StatusOK, batch)
+	}))
+}
+
+// authenticate - only passes on requests with a valid bearer token
+func (in *Ingester) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for _, valid := range in.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ingest"`)
+		WriteError(w, r, NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "A valid ingest token is required"))
+	})
+}
+
+// process - publishes the messages one at a time, so they're handled in the
+// order they were given
+func (in *Ingester) process(ctx context.Context, batch *IngestBatch, messages []json.RawMessage) {
+	for i, msg := range messages {
+		result := IngestResult{Index: i}
+		folderWatchMsg := rabbitMQ.FolderWatchMessage{}
+		if err := json.Unmarshal(msg, &folderWatchMsg); err != nil {
+			result.Error = fmt.Sprintf("Can't unmarshal FolderWatch update %v", err)
+		} else {
+			result.Action, result.Path = folderWatchMsg.Action, folderWatchMsg.Path
+			if err := in.source.Publish(ctx, IngestRoutingKey, msg); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		result.OK = result.Error == ""
+
+		in.mu.Lock()
+		batch.Results[i] = result
+		batch.Processed++
+		if !result.OK {
+			batch.Failed++
+		}
+		in.mu.Unlock()
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	completed := time.Now()
+	batch.Complete, batch.Completed = true, &completed
+	if batch.ID != "" {
+		logging.Ctx(ctx).Info().Str("id", batch.ID).Int("processed", batch.Processed).Int("failed", batch.Failed).Msg("Ingest request complete")
+	}
+}
+
+// track - records an async request, dropping any completed long enough ago
+func (in *Ingester) track(batch *IngestBatch) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for id, tracked := range in.batches {
+		if tracked.Complete && time.Since(*tracked.Completed) > ingestRetention {
+			delete(in.batches, id)
+		}
+	}
+	in.batches[batch.ID] = batch
+}
+
+// lookup - returns a copy of the tracked request, as it may still be updated
+func (in *Ingester) lookup(id string) (*IngestBatch, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	batch, ok := in.batches[id]
+	if !ok {
+		return nil, false
+	}
+	snapshot := *batch
+	snapshot.Results = append([]IngestResult(nil), batch.Results[:batch.Processed]...)
+	return &snapshot, true
+}
+
+// readIngestMessages - splits the request body into its messages, which are
+// either newline delimited or a single JSON value (object or array)
+func readIngestMessages(r *http.Request) ([]json.RawMessage, error) {
+	body := http.MaxBytesReader(nil, r.Body, maxIngestBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var messages []json.RawMessage
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), maxIngestBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			messages = append(messages, append(json.RawMessage(nil), line...))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, bodyReadError(err)
+		}
+	} else {
+		data, err := ioutil.ReadAll(body)
+		if err != nil && err != io.EOF {
+			return nil, bodyReadError(err)
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '[' {
+			if err := json.Unmarshal(data, &messages); err != nil {
+				return nil, badRequest("The request body isn't a JSON array of messages %v", err)
+			}
+		} else if len(data) > 0 {
+			messages = append(messages, json.RawMessage(data))
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, badRequest("The request doesn't contain any messages")
+	}
+	return messages, nil
+}
+
+// bodyReadError - the error for a request body that couldn't be read, which
+// is either too large or cut short
+func bodyReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return NewAPIError(http.StatusRequestEntityTooLarge, CodeTooLarge, "The request body is larger than %d bytes", tooLarge.Limit)
+	}
+	return badRequest("Failed to read the request body %v", err)
+}
+
+func writeIngestBatch(w http.ResponseWriter, r *http.Request, status int, batch *IngestBatch) {
+	js, err := json.Marshal(batch)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func newTrackingID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("Failed to generate a tracking ID %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
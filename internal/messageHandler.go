@@ -5,54 +5,149 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/clwilliams/tlWatchFolderAggregator/cache"
+	"github.com/clwilliams/tlWatchFolderAggregator/changes"
 	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
 )
 
+// FolderWatchHandler - the name the folder watch handler is registered under
+const FolderWatchHandler = "folderWatch"
+
+var tracer = tracing.Tracer("internal")
+
+// MessageHandler - a message handler that bindings can refer to by name,
+// along with the key used to keep its messages in order
+type MessageHandler struct {
+	Handle       func(context.Context, []byte) error
+	PartitionKey func([]byte) string
+}
+
+// MessageHandlers - the registry of message handlers, by name. The listings
+// are told of every change they make, & the feed of those that succeed, both
+// nil when nothing is served
+func MessageHandlers(config *elasticSearch.App, listings *cache.Listings, feed *changes.Feed) map[string]MessageHandler {
+	return map[string]MessageHandler{
+		FolderWatchHandler: {
+			Handle:       HandleFolderWatchUpdate(config, listings, feed),
+			PartitionKey: FolderWatchPartitionKey,
+		},
+	}
+}
+
 // HandleFolderWatchUpdate - given the message body from RabbitMQ, marshall
 // into the folder watch message entity & based on the action, send to the
 // appropriate method for handling the message
-func HandleFolderWatchUpdate(config *elasticSearch.App) func(context.Context, []byte) error {
+func HandleFolderWatchUpdate(config *elasticSearch.App, listings *cache.Listings, feed *changes.Feed) func(context.Context, []byte) error {
 	return func(ctx context.Context, msg []byte) error {
 
 		folderWatchMsg := rabbitMQ.FolderWatchMessage{}
 		if err := json.Unmarshal(msg, &folderWatchMsg); err != nil {
-			log.Errorf("Can't unmarshal FolderWatch update %v : %v", err, string(msg))
+			logging.Ctx(ctx).Error().Err(err).Str("message", string(msg)).Msg("Can't unmarshal FolderWatch update")
+			metrics.FolderWatchMessages.WithLabelValues("invalid", "failure").Inc()
 			return nil
 		}
 
 		if config.Verbose {
-			log.Infof("HandleFolderWatchUpdate for %#v", folderWatchMsg)
+			logging.Ctx(ctx).Info().
+				Str("action", folderWatchMsg.Action).
+				Str("path", folderWatchMsg.Path).
+				Str("isDir", folderWatchMsg.IsDir).
+				Msg("HandleFolderWatchUpdate")
 		}
 
+		// record the outcome & how long it took, by action
+		action := folderWatchMsg.Action
+		started := time.Now()
+		ctx, span := tracer.Start(ctx, "folderWatch "+action, trace.WithAttributes(
+			attribute.String("folderWatch.action", action),
+			attribute.String("folderWatch.path", folderWatchMsg.Path),
+			attribute.String("folderWatch.isDir", folderWatchMsg.IsDir),
+		))
+		var err error
 		switch folderWatchMsg.Action {
 		case rabbitMQ.CreateAction:
 			{
-				return handleCreate(config, &folderWatchMsg)
+				err = handleCreate(ctx, config, &folderWatchMsg)
 			}
 		case rabbitMQ.DeleteAction:
 			{
-				return handleDelete(config, &folderWatchMsg)
+				err = handleDelete(ctx, config, &folderWatchMsg)
 			}
 		case rabbitMQ.RenameAction:
 			{
-				return handleRename(config, &folderWatchMsg)
+				err = handleRename(ctx, config, &folderWatchMsg)
 			}
 		case rabbitMQ.MoveAction:
 			{
-				return handleMove(config, &folderWatchMsg)
+				err = handleMove(ctx, config, &folderWatchMsg)
 			}
 		default:
 			// we shouldn't have any unhandled case as the watcher is configured to
 			// report the above 4 actions, but should something else arrive, raise an
 			// error so we report it's not something we currently handle
-			return fmt.Errorf("This message handler doesn't support action %s. Message: %#v",
+			action = "unsupported"
+			err = fmt.Errorf("This message handler doesn't support action %s. Message: %#v",
 				folderWatchMsg.Action, folderWatchMsg)
 		}
+		if action != "unsupported" {
+			// even a failed action may have changed some of the index. Renames
+			// & moves change both the old & new paths
+			listings.Changed(strings.Split(folderWatchMsg.Path, " -> ")...)
+			// only what was applied is passed on to those watching
+			if err == nil {
+				feed.Publish(folderWatchChange(&folderWatchMsg))
+			}
+		}
+		tracing.End(span, err)
+		metrics.FolderWatchDuration.WithLabelValues(action).Observe(time.Since(started).Seconds())
+		metrics.FolderWatchMessages.WithLabelValues(action, metrics.Outcome(err)).Inc()
+		return err
+	}
+}
+
+// folderWatchChange - the change the message applied to the index. Renames
+// & moves give the old & new paths
+func folderWatchChange(folderWatchMsg *rabbitMQ.FolderWatchMessage) changes.Change {
+	change := changes.Change{
+		Action:      folderWatchMsg.Action,
+		Path:        folderWatchMsg.Path,
+		IsDir:       folderWatchMsg.IsDir == "true",
+		WatchFolder: folderWatchMsg.WatchFolder,
+		Time:        time.Now(),
 	}
+	if paths := strings.Split(folderWatchMsg.Path, " -> "); len(paths) == 2 {
+		change.OldPath, change.Path = paths[0], paths[1]
+	}
+	return change
+}
+
+// FolderWatchPartitionKey - returns the key used to decide which worker
+// processes a message. It's the watch folder the message came from, so every
+// event within it is processed in the order it was sent. Deleting, renaming or
+// moving a folder applies to everything beneath it, so has to stay in order
+// with the events for its contents, which keying by the parent folder
+// wouldn't. Messages without a watch folder are keyed by the first folder of
+// their (original) path
+func FolderWatchPartitionKey(msg []byte) string {
+	folderWatchMsg := rabbitMQ.FolderWatchMessage{}
+	if err := json.Unmarshal(msg, &folderWatchMsg); err != nil {
+		// the handler will report the message, so any worker will do
+		return ""
+	}
+	if folderWatchMsg.WatchFolder != "" {
+		return strings.TrimSuffix(folderWatchMsg.WatchFolder, "/")
+	}
+	path := strings.TrimPrefix(strings.Split(folderWatchMsg.Path, " -> ")[0], "/")
+	return "/" + strings.SplitN(path, "/", 2)[0]
 }
 
 func retrieveName(folderPath string) string {
@@ -73,7 +168,7 @@ func retrieveName(folderPath string) string {
     IsDir:"false"
   }
 */
-func handleCreate(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
+func handleCreate(ctx context.Context, config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
 	id := generateUniqueID(folderWatchMsg.Path, folderWatchMsg.IsDir)
 	// retrieve the name from the full folder path
 	name := retrieveName(folderWatchMsg.Path)
@@ -98,7 +193,7 @@ func handleCreate(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
 	}
 
 	// & save
-	err := config.Save(fsNode, id)
+	err := config.Save(ctx, fsNode, id)
 	if err != nil {
 		return fmt.Errorf("Error storing in elastic search %#v", err)
 	}
@@ -114,12 +209,25 @@ func handleCreate(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
     IsDir:"false"
   }
 */
-func handleDelete(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
+func handleDelete(ctx context.Context, config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
 	id := generateUniqueID(folderWatchMsg.Path, folderWatchMsg.IsDir)
 	if config.Verbose {
-		log.Infof("handleDelete for id %#v", id)
+		logging.Ctx(ctx).Info().Str("id", id).Msg("handleDelete")
+	}
+	// a folder's contents go with it, without a message of their own. That
+	// relies on the events for the contents being processed in order with
+	// it, which FolderWatchPartitionKey keeps by keying them all by their
+	// watch folder. Otherwise a file created in the folder after it was
+	// recreated could be deleted, or one created before it was deleted left
+	// behind
+	if folderWatchMsg.IsDir == "true" {
+		deleted, err := config.DeleteFsNodes(ctx, folderWatchMsg.Path)
+		if err != nil {
+			return fmt.Errorf("Error deleting the contents of %s %v", folderWatchMsg.Path, err)
+		}
+		logging.Ctx(ctx).Debug().Str("folder", folderWatchMsg.Path).Int64("deleted", deleted).Msg("Deleted folder contents")
 	}
-	err := config.Delete(id)
+	err := config.Delete(ctx, id)
 	if err != nil {
 		return fmt.Errorf("Error deleting document with ID %s %v", id, err)
 	}
@@ -138,7 +246,7 @@ func handleDelete(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
 	we don't just perform an update to the existing document, we remove it and add a new one
 	with the updated folder path / name and new id
 */
-func handleRename(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
+func handleRename(ctx context.Context, config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
 	paths := strings.Split(folderWatchMsg.Path, " -> ")
 	if len(paths) != 2 {
 		return fmt.Errorf("Rename operation needs to have the old and new names in order to process change. %#v", folderWatchMsg)
@@ -148,14 +256,14 @@ func handleRename(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
 
 	// retrieve the original document from elastic search
 	originalID := generateUniqueID(oldFullPath, folderWatchMsg.IsDir)
-	originalDoc, err := config.Get(originalID)
+	originalDoc, err := config.Get(ctx, originalID)
 	if err != nil {
 		return fmt.Errorf("Error renaming: error retrieve original document with ID %s %v",
 			originalID, err)
 	}
 
 	// delete the original
-	err = config.Delete(originalID)
+	err = config.Delete(ctx, originalID)
 	if err != nil {
 		return fmt.Errorf("Error renaming: can't delete original document with ID %s %v",
 			originalID, err)
@@ -165,12 +273,24 @@ func handleRename(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
 	originalDoc.Name = retrieveName(newFullPath)
 	originalDoc.FullPath = newFullPath
 	newID := generateUniqueID(newFullPath, folderWatchMsg.IsDir)
-	err = config.Save(originalDoc, newID)
+	err = config.Save(ctx, originalDoc, newID)
 	if err != nil {
 		return fmt.Errorf("Error renaming: can't save renamed document with ID %s %v",
 			newID, err)
 	}
 
+	// a folder's contents move with it, without a message of their own, so
+	// they have to be processed in order with it, as for handleDelete. A
+	// move between watch folders is keyed by the one it's from, so may still
+	// be processed out of order with events in the one it's moved to
+	if folderWatchMsg.IsDir == "true" {
+		moved, err := config.MoveFsNodes(ctx, oldFullPath, newFullPath, fsNodeID)
+		if err != nil {
+			return fmt.Errorf("Error renaming: can't move the contents of %s %v", oldFullPath, err)
+		}
+		logging.Ctx(ctx).Debug().Str("folder", newFullPath).Int64("moved", moved).Msg("Moved folder contents")
+	}
+
 	return nil
 }
 
@@ -185,8 +305,13 @@ func handleRename(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatc
 	moving is the same as a rename operation in that it will result in a id, name and full path change,
 	so just call the handleRename
 */
-func handleMove(config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
-	return handleRename(config, folderWatchMsg)
+func handleMove(ctx context.Context, config *elasticSearch.App, folderWatchMsg *rabbitMQ.FolderWatchMessage) error {
+	return handleRename(ctx, config, folderWatchMsg)
+}
+
+// fsNodeID - the ID the node is stored under
+func fsNodeID(fsNode elasticSearch.FsNode) string {
+	return generateUniqueID(fsNode.FullPath, fmt.Sprintf("%t", fsNode.IsDir))
 }
 
 // GenerateUniqueID - calculate the ID for storing document in elastic search
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+)
+
+// partitionKey - the key of a folder watch message
+func partitionKey(t *testing.T, msg rabbitMQ.FolderWatchMessage) string {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FolderWatchPartitionKey(body)
+}
+
+func TestAFoldersEventsStayInOrderWithItsContents(t *testing.T) {
+	deleteFolder := rabbitMQ.FolderWatchMessage{Action: rabbitMQ.DeleteAction, Path: "/w/a", IsDir: "true", WatchFolder: "/w"}
+	for _, msg := range []rabbitMQ.FolderWatchMessage{
+		{Action: rabbitMQ.CreateAction, Path: "/w/a/x", IsDir: "false", WatchFolder: "/w"},
+		{Action: rabbitMQ.CreateAction, Path: "/w/a/b/y", IsDir: "false", WatchFolder: "/w/"},
+		{Action: rabbitMQ.MoveAction, Path: "/w/c/z -> /w/a/z", IsDir: "false", WatchFolder: "/w"},
+	} {
+		if got, want := partitionKey(t, msg), partitionKey(t, deleteFolder); got != want {
+			t.Errorf("%s %s was keyed %q, the folder's delete %q", msg.Action, msg.Path, got, want)
+		}
+	}
+	if other := partitionKey(t, rabbitMQ.FolderWatchMessage{Action: rabbitMQ.CreateAction, Path: "/v/a", WatchFolder: "/v"}); other == partitionKey(t, deleteFolder) {
+		t.Error("Another watch folder shares a key")
+	}
+}
+
+func TestMessagesWithoutAWatchFolderAreKeyedByTheirFirstFolder(t *testing.T) {
+	for fullPath, want := range map[string]string{
+		"/w/a":          "/w",
+		"/w/a/x":        "/w",
+		"/w/a -> /v/a":  "/w",
+		"relative/path": "/relative",
+	} {
+		if got := partitionKey(t, rabbitMQ.FolderWatchMessage{Action: rabbitMQ.CreateAction, Path: fullPath}); got != want {
+			t.Errorf("%s was keyed %q, want %q", fullPath, got, want)
+		}
+	}
+	if got := FolderWatchPartitionKey([]byte("not json")); got != "" {
+		t.Errorf("An unreadable message was keyed %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/ratelimit"
+)
+
+// LimitRate - router middleware limiting the rate each client may call each
+// route at, other than the exempt routes (by path template). Clients are told
+// when to retry with a 429. It runs before Authenticate, so guessing
+// credentials is limited too. Clients are identified by their principal when
+// their credentials are valid, which is passed on so they aren't checked
+// again, otherwise by their address. When the API is behind trusted proxies
+// that's taken from X-Forwarded-For, see forwardedClient. The authenticator is
+// nil without authentication
+func LimitRate(limiter *ratelimit.Limiter, authenticator *auth.Auth, trustedProxies int, exempt ...string) mux.MiddlewareFunc {
+	exemptRoutes := map[string]bool{}
+	for _, route := range exempt {
+		exemptRoutes[route] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			if exemptRoutes[route] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if authenticator != nil {
+				if principal, err := authenticator.Authenticate(r); err == nil {
+					r = withPrincipal(r, principal)
+				}
+			}
+			allowed, retryAfter := limiter.Allow(route, rateLimitClient(r, trustedProxies))
+			if !allowed {
+				metrics.RateLimited.WithLabelValues(route).Inc()
+				seconds := int(math.Max(1, math.Ceil(retryAfter.Seconds())))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				WriteError(w, r, NewAPIError(http.StatusTooManyRequests, CodeRateLimited, "Too many requests, retry after %ds", seconds))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitClient - who the request's rate is limited as
+func rateLimitClient(r *http.Request, trustedProxies int) string {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return "principal:" + principal.Name
+	}
+	if forwarded := forwardedClient(r.Header.Values("X-Forwarded-For"), trustedProxies); forwarded != "" {
+		return "address:" + forwarded
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "address:" + host
+}
+
+// forwardedClient - the client's address from the X-Forwarded-For headers,
+// given the number of trusted proxies in front of the API. Each proxy appends
+// the address it was called from, so the client is that many addresses from
+// the right. Those further left were sent by the client, so can't be trusted
+func forwardedClient(headers []string, trustedProxies int) string {
+	if trustedProxies < 1 {
+		return ""
+	}
+	var addresses []string
+	for _, header := range headers {
+		for _, address := range strings.Split(header, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return ""
+	}
+	// with fewer addresses than proxies, the first proxy was called directly
+	i := len(addresses) - trustedProxies
+	if i < 0 {
+		i = 0
+	}
+	return addresses[i]
+}
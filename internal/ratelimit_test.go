@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+func TestForwardedClientIsTrustedProxiesFromTheRight(t *testing.T) {
+	for _, test := range []struct {
+		headers []string
+		proxies int
+		want    string
+	}{
+		{[]string{"203.0.113.9"}, 1, "203.0.113.9"},
+		// the client can send its own X-Forwarded-For, the proxy appends to it
+		{[]string{"198.51.100.1, 203.0.113.9"}, 1, "203.0.113.9"},
+		{[]string{"198.51.100.1", "203.0.113.9"}, 1, "203.0.113.9"},
+		{[]string{"198.51.100.1, 203.0.113.9, 10.0.0.2"}, 2, "203.0.113.9"},
+		{[]string{"203.0.113.9"}, 3, "203.0.113.9"},
+		{[]string{"203.0.113.9"}, 0, ""},
+		{nil, 1, ""},
+	} {
+		if got := forwardedClient(test.headers, test.proxies); got != test.want {
+			t.Errorf("forwardedClient(%q, %d) = %q, want %q", test.headers, test.proxies, got, test.want)
+		}
+	}
+}
+
+func TestLimitRateIdentifiesClients(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Limit{Rate: 1, Burst: 1}, nil)
+	router := mux.NewRouter()
+	router.Use(LimitRate(limiter, nil, 1, "/healthz"))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router.Handle("/all", ok)
+	router.Handle("/healthz", ok)
+
+	call := func(target, forwardedFor string, principal *auth.Principal) int {
+		r := httptest.NewRequest("GET", target, nil)
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if principal != nil {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := call("/all", "198.51.100.1, 203.0.113.9", nil); code != http.StatusOK {
+		t.Fatalf("The first request responded %d", code)
+	}
+	// a new leftmost address doesn't make for a new client
+	if code := call("/all", "198.51.100.2, 203.0.113.9", nil); code != http.StatusTooManyRequests {
+		t.Errorf("Spoofing X-Forwarded-For responded %d, want 429", code)
+	}
+	if code := call("/all", "203.0.113.10", nil); code != http.StatusOK {
+		t.Errorf("Another client responded %d", code)
+	}
+	if code := call("/all", "203.0.113.9", &auth.Principal{Name: "office"}); code != http.StatusOK {
+		t.Errorf("An authenticated client responded %d, want it limited by principal", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := call("/healthz", "203.0.113.9", nil); code != http.StatusOK {
+			t.Fatalf("An exempt route responded %d", code)
+		}
+	}
+}
+
+func TestFailingToAuthenticateIsLimited(t *testing.T) {
+	authenticator, err := auth.New(&auth.Config{
+		APIKeys: []auth.APIKey{{Key: "office-key", Principal: "office"}},
+		Rules:   []auth.Rule{{Principal: "office", Prefixes: []string{"/w"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.New(ratelimit.Limit{Rate: 1, Burst: 1}, nil)
+	router := mux.NewRouter()
+	router.Use(LimitRate(limiter, authenticator, 0), Authenticate(authenticator))
+	router.Handle("/all", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal := auth.FromContext(r.Context()); principal == nil || principal.Name != "office" {
+			t.Errorf("Handled as %+v, want office", principal)
+		}
+	}))
+
+	call := func(apiKey string) int {
+		r := httptest.NewRequest("GET", "/all", nil)
+		r.Header.Set(auth.APIKeyHeader, apiKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := call("guess-1"); code != http.StatusUnauthorized {
+		t.Fatalf("The first guess responded %d, want 401", code)
+	}
+	if code := call("guess-2"); code != http.StatusTooManyRequests {
+		t.Errorf("The second guess responded %d, want 429", code)
+	}
+	// from the same address, but limited as its principal
+	if code := call("office-key"); code != http.StatusOK {
+		t.Errorf("A valid key responded %d, want 200", code)
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	es "github.com/olivere/elastic"
+)
+
+// memoryStore - an FsNodeStore holding its nodes in memory, ordered by path,
+// as the index would return them. Every call fails with err when it's set
+type memoryStore struct {
+	nodes []elasticSearch.FsNode
+	err   error
+}
+
+func newMemoryStore(nodes ...elasticSearch.FsNode) *memoryStore {
+	for i := range nodes {
+		nodes[i].ParentPath = path.Dir(nodes[i].FullPath)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].FullPath < nodes[j].FullPath })
+	return &memoryStore{nodes: nodes}
+}
+
+// Get - the node is found by its ID, as the index would
+func (s *memoryStore) Get(ctx context.Context, id string) (elasticSearch.FsNode, error) {
+	if s.err != nil {
+		return elasticSearch.FsNode{}, s.err
+	}
+	for _, fsNode := range s.nodes {
+		if generateUniqueID(fsNode.FullPath, strconv.FormatBool(fsNode.IsDir)) == id {
+			return fsNode, nil
+		}
+	}
+	return elasticSearch.FsNode{}, &es.Error{Status: http.StatusNotFound}
+}
+
+func (s *memoryStore) GetAllFsNodes(ctx context.Context) ([]elasticSearch.FsNode, int64, error) {
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	return s.nodes, int64(len(s.nodes)), nil
+}
+
+// GetFsNodesForWatchFolder - the nodes whose path starts with the folder's,
+// not bounded by path separators like the index's prefix matching
+func (s *memoryStore) GetFsNodesForWatchFolder(ctx context.Context, folderPath string) ([]elasticSearch.FsNode, int64, error) {
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	var fsNodes []elasticSearch.FsNode
+	for _, fsNode := range s.nodes {
+		if strings.HasPrefix(fsNode.FullPath, folderPath) {
+			fsNodes = append(fsNodes, fsNode)
+		}
+	}
+	return fsNodes, int64(len(fsNodes)), nil
+}
+
+func (s *memoryStore) ScrollFsNodes(ctx context.Context, folderPath string, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+	fsNodes, totalHits, err := s.GetFsNodesForWatchFolder(ctx, folderPath)
+	if err != nil {
+		return err
+	}
+	return scrollAll(fsNodes, totalHits, start, each)
+}
+
+// ListFsNodes - the nodes beneath the folder by whole path segments, down to
+// the depth
+func (s *memoryStore) ListFsNodes(ctx context.Context, folderPath string, depth int, start func(totalHits int64), each func(elasticSearch.FsNode) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	folderPath = path.Clean(folderPath)
+	prefix := strings.TrimSuffix(folderPath, "/") + "/"
+	var fsNodes []elasticSearch.FsNode
+	for _, fsNode := range s.nodes {
+		if !strings.HasPrefix(fsNode.FullPath, prefix) {
+			continue
+		}
+		if depth > 0 && strings.Count(strings.TrimPrefix(fsNode.FullPath, prefix), "/") >= depth {
+			continue
+		}
+		fsNodes = append(fsNodes, fsNode)
+	}
+	return scrollAll(fsNodes, int64(len(fsNodes)), start, each)
+}
+
+// scrollAll - calls start then each as a scroll through the nodes would
+func scrollAll(fsNodes []elasticSearch.FsNode, totalHits int64, start func(int64), each func(elasticSearch.FsNode) error) error {
+	start(totalHits)
+	for _, fsNode := range fsNodes {
+		if err := each(fsNode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package journal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// segmentExt - the extension of the journal's segment files, which are named
+// by the time they were started so they sort in the order they were written
+const segmentExt = ".journal"
+
+// headerSize - each record starts with the length of the rest of the record,
+// its checksum, the time it was written & the length of the handler name
+const headerSize = 4 + 4 + 8 + 2
+
+// maxRecordSize - the largest record that will be read, so a corrupt length
+// can't exhaust memory
+const maxRecordSize = 256 << 20
+
+// crcTable - checksums are CRC-32C, covering everything after the checksum
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Entry - a message that was processed successfully, & the handler that
+// processed it
+type Entry struct {
+	Time    time.Time
+	Handler string
+	Body    []byte
+}
+
+// Journal - an append-only record of every message processed, so the index
+// can be rebuilt from it. It's written as a series of segment files, a new
+// one being started on opening the journal or once the current one reaches
+// the maximum segment size
+type Journal struct {
+	dir            string
+	maxSegmentSize int64
+
+	mu      sync.Mutex
+	segment *os.File
+	size    int64
+}
+
+// Open - opens the journal in the directory, creating the directory if needed
+func Open(dir string, maxSegmentSize int64) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create journal directory %s %v", dir, err)
+	}
+	return &Journal{dir: dir, maxSegmentSize: maxSegmentSize}, nil
+}
+
+// Record - wraps the handler, so that every message it processes
+// successfully is appended to the journal under the handler's name. Should
+// it fail to be journalled the message has still been applied to the index,
+// so it isn't failed (& dead lettered) for it. The error is given to failed
+// instead, leaving the journal a message short of the index until it's
+// rebuilt
+func (j *Journal) Record(handlerName string, handle func(context.Context, []byte) error, failed func(error)) func(context.Context, []byte) error {
+	return func(ctx context.Context, msg []byte) error {
+		if err := handle(ctx, msg); err != nil {
+			return err
+		}
+		if err := j.Append(Entry{Time: time.Now(), Handler: handlerName, Body: msg}); err != nil {
+			failed(fmt.Errorf("Failed to journal a %s message %v", handlerName, err))
+		}
+		return nil
+	}
+}
+
+// Append - writes the entry to the end of the journal, only returning once
+// it's been flushed to disk so a crash can't lose it
+func (j *Journal) Append(entry Entry) error {
+	if len(entry.Handler) > 0xffff {
+		return errors.New("The handler name is too long to journal")
+	}
+	record := make([]byte, headerSize+len(entry.Handler)+len(entry.Body))
+	if len(record) > maxRecordSize {
+		return fmt.Errorf("The message is too large to journal, %d bytes", len(entry.Body))
+	}
+	binary.BigEndian.PutUint32(record[0:], uint32(len(record)-4))
+	binary.BigEndian.PutUint64(record[8:], uint64(entry.Time.UnixNano()))
+	binary.BigEndian.PutUint16(record[16:], uint16(len(entry.Handler)))
+	copy(record[headerSize:], entry.Handler)
+	copy(record[headerSize+len(entry.Handler):], entry.Body)
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(record[8:], crcTable))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.segment == nil || j.size >= j.maxSegmentSize {
+		if err := j.startSegment(entry.Time); err != nil {
+			return err
+		}
+	}
+	// the record is written in one go, so a crash can only ever leave the
+	// last record of a segment part written
+	n, err := j.segment.Write(record)
+	j.size += int64(n)
+	if err != nil {
+		err = fmt.Errorf("Failed to write to journal segment %s %v", j.segment.Name(), err)
+		// anything part written ends the segment, the next entry starts another
+		j.closeSegment()
+		return err
+	}
+	if err := j.segment.Sync(); err != nil {
+		err = fmt.Errorf("Failed to flush journal segment %s %v", j.segment.Name(), err)
+		j.closeSegment()
+		return err
+	}
+	return nil
+}
+
+// startSegment - closes the current segment & starts a new one. Must be
+// called holding the lock
+func (j *Journal) startSegment(at time.Time) error {
+	if err := j.closeSegment(); err != nil {
+		return err
+	}
+	name := filepath.Join(j.dir, fmt.Sprintf("%020d%s", at.UnixNano(), segmentExt))
+	segment, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create journal segment %s %v", name, err)
+	}
+	j.segment, j.size = segment, 0
+	return nil
+}
+
+// closeSegment - flushes the current segment to disk & closes it. Must be
+// called holding the lock
+func (j *Journal) closeSegment() error {
+	if j.segment == nil {
+		return nil
+	}
+	segment := j.segment
+	j.segment = nil
+	if err := segment.Sync(); err != nil {
+		segment.Close()
+		return fmt.Errorf("Failed to flush journal segment %s %v", segment.Name(), err)
+	}
+	return segment.Close()
+}
+
+// Close - flushes the journal to disk
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.closeSegment()
+}
@@ -0,0 +1,95 @@
+package journal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// replayAll - every entry in the journal
+func replayAll(t *testing.T, dir string) []Entry {
+	t.Helper()
+	var entries []Entry
+	err := Replay(dir, time.Time{}, func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}, func(Progress) {})
+	if err != nil {
+		t.Fatalf("Replaying failed %v", err)
+	}
+	return entries
+}
+
+func TestAppendedEntriesAreReplayedWithoutClosing(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2019, 3, 12, 10, 0, 0, 0, time.UTC)
+	for _, body := range []string{"one", "two"} {
+		if err := j.Append(Entry{Time: at, Handler: "folderWatch", Body: []byte(body)}); err != nil {
+			t.Fatalf("Appending failed %v", err)
+		}
+	}
+
+	// as if the process had died, the segment's never closed
+	entries := replayAll(t, dir)
+	if len(entries) != 2 || string(entries[0].Body) != "one" || string(entries[1].Body) != "two" {
+		t.Fatalf("Replayed %v, want one & two", entries)
+	}
+	if entries[0].Handler != "folderWatch" || !entries[0].Time.Equal(at) {
+		t.Errorf("Replayed %s at %v, want folderWatch at %v", entries[0].Handler, entries[0].Time, at)
+	}
+}
+
+func TestRecordOnlyJournalsHandledMessages(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	failure := errors.New("Can't index")
+	handle := j.Record("folderWatch", func(ctx context.Context, msg []byte) error {
+		if string(msg) == "bad" {
+			return failure
+		}
+		return nil
+	}, func(err error) { t.Errorf("Journalling failed %v", err) })
+
+	if err := handle(context.Background(), []byte("good")); err != nil {
+		t.Errorf("Handling gave %v", err)
+	}
+	if err := handle(context.Background(), []byte("bad")); err != failure {
+		t.Errorf("Handling gave %v, want the handler's error", err)
+	}
+	if entries := replayAll(t, dir); len(entries) != 1 || string(entries[0].Body) != "good" {
+		t.Errorf("Replayed %v, want only the good message", entries)
+	}
+}
+
+func TestRecordDoesntFailMessagesItCantJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the segment can't be created without the directory
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	var failures []error
+	handle := j.Record("folderWatch", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, func(err error) { failures = append(failures, err) })
+
+	if err := handle(context.Background(), []byte("one")); err != nil {
+		t.Errorf("Handling gave %v, want the applied message not failed", err)
+	}
+	if len(failures) != 1 {
+		t.Errorf("Reported %v, want the journal's error", failures)
+	}
+}
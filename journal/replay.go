@@ -0,0 +1,161 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// progressInterval - how often progress is reported whilst replaying
+const progressInterval = time.Second
+
+// Progress - how far through the journal a replay is
+type Progress struct {
+	Segment    string
+	Entries    int
+	BytesRead  int64
+	TotalBytes int64
+}
+
+// Percent - the proportion of the journal read so far
+func (p Progress) Percent() float64 {
+	if p.TotalBytes == 0 {
+		return 100
+	}
+	return float64(p.BytesRead) * 100 / float64(p.TotalBytes)
+}
+
+// Replay - reads the journal in the order it was written, passing each entry
+// to apply, until an entry written after until (when it's set) is reached.
+// Progress is reported periodically & once the replay is complete. A record
+// left part written by a crash ends its segment, whereas a record failing its
+// checksum stops the replay
+func Replay(dir string, until time.Time, apply func(Entry) error, progress func(Progress)) error {
+	segments, totalBytes, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	status := Progress{TotalBytes: totalBytes}
+	lastReport := time.Now()
+	for _, segment := range segments {
+		status.Segment = filepath.Base(segment)
+		done, err := replaySegment(segment, until, func(entry Entry, size int64) error {
+			if err := apply(entry); err != nil {
+				return err
+			}
+			status.Entries++
+			status.BytesRead += size
+			if progress != nil && time.Since(lastReport) >= progressInterval {
+				progress(status)
+				lastReport = time.Now()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	if progress != nil {
+		status.BytesRead = status.TotalBytes
+		progress(status)
+	}
+	return nil
+}
+
+// listSegments - the journal's segment files in the order they were written,
+// along with their total size
+func listSegments(dir string) ([]string, int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to read journal directory %s %v", dir, err)
+	}
+	var segments []string
+	var totalBytes int64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentExt) {
+			continue
+		}
+		segments = append(segments, filepath.Join(dir, file.Name()))
+		totalBytes += file.Size()
+	}
+	sort.Strings(segments)
+	return segments, totalBytes, nil
+}
+
+// replaySegment - reads the segment's records, returning true once an entry
+// after until is reached
+func replaySegment(segment string, until time.Time, apply func(Entry, int64) error) (bool, error) {
+	file, err := os.Open(segment)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open journal segment %s %v", segment, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		entry, size, err := readRecord(reader)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// the process stopped part way through writing the record
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("Journal segment %s is corrupt at offset %d %v", segment, offset, err)
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			return true, nil
+		}
+		if err := apply(entry, size); err != nil {
+			return false, err
+		}
+		offset += size
+	}
+}
+
+// readRecord - reads & checks a single record, returning its entry & size
+func readRecord(reader io.Reader) (Entry, int64, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return Entry{}, 0, err
+	}
+	recordLength := binary.BigEndian.Uint32(length[:])
+	if recordLength < headerSize-4 || recordLength > maxRecordSize {
+		return Entry{}, 0, fmt.Errorf("Record length %d is invalid", recordLength)
+	}
+	record := make([]byte, recordLength)
+	if _, err := io.ReadFull(reader, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Entry{}, 0, err
+	}
+
+	checksum := binary.BigEndian.Uint32(record[0:])
+	if crc32.Checksum(record[4:], crcTable) != checksum {
+		return Entry{}, 0, fmt.Errorf("Record checksum doesn't match")
+	}
+	handlerLength := int(binary.BigEndian.Uint16(record[12:]))
+	if 14+handlerLength > len(record) {
+		return Entry{}, 0, fmt.Errorf("Record handler name overruns the record")
+	}
+	return Entry{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(record[4:]))),
+		Handler: string(record[14 : 14+handlerLength]),
+		Body:    record[14+handlerLength:],
+	}, int64(len(length) + len(record)), nil
+}
@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	stdlog "log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/recorder"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// CorrelationHeader - the header a correlation ID is passed in, on both
+	// API requests & messages
+	CorrelationHeader = "X-Correlation-ID"
+	// RequestIDHeader - the header an API request's ID is taken from, & given
+	// back in
+	RequestIDHeader = "X-Request-ID"
+)
+
+// disabled - the logger of contexts that weren't given one
+var disabled = zerolog.Nop()
+
+type (
+	correlationKey struct{}
+	loggerKey      struct{}
+)
+
+// New - the logger the aggregator logs through, to stderr in either the json
+// or console format. It's given to each package, & carried by the contexts
+// they're handed. The standard library's logger is sent through it too
+func New(format string) zerolog.Logger {
+	var out io.Writer = os.Stderr
+	if format == "console" {
+		out = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	}
+	logger := zerolog.New(out).With().Timestamp().Logger()
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logger)
+	return logger
+}
+
+// Ctx - the logger for the context, carrying its correlation ID. Nothing is
+// logged for a context that wasn't given one
+func Ctx(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &disabled
+}
+
+// WithLogger - a context logged to by the logger
+func WithLogger(ctx context.Context, logger zerolog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, &logger)
+}
+
+// WithCorrelationID - a context whose logger includes the correlation ID, a
+// new one is generated when the ID given is empty
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		id = NewCorrelationID()
+	}
+	logger := Ctx(ctx).With().Str("correlationId", id).Logger()
+	return context.WithValue(WithLogger(ctx, logger), correlationKey{}, id)
+}
+
+// CorrelationID - the context's correlation ID, if it has one
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Detach - a context with the logger & correlation ID of ctx, but not its
+// deadline or cancellation, for work that outlives a request
+func Detach(ctx context.Context) context.Context {
+	detached := context.WithValue(context.Background(), loggerKey{}, Ctx(ctx))
+	return context.WithValue(detached, correlationKey{}, CorrelationID(ctx))
+}
+
+// NewCorrelationID - a random ID
+func NewCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// not worth failing over, the time will do
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// LogRequests - router middleware giving each request a correlation ID, from
+// its X-Request-ID or X-Correlation-ID header if it has one, which is
+// returned in the response's X-Request-ID header. Once served the request is
+// logged
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = r.Header.Get(CorrelationHeader)
+		}
+		ctx := WithCorrelationID(r.Context(), id)
+		w.Header().Set(RequestIDHeader, CorrelationID(ctx))
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		response := recorder.New(w)
+		started := time.Now()
+		next.ServeHTTP(response, r.WithContext(ctx))
+		Ctx(ctx).Info().
+			Str("method", r.Method).
+			Str("route", route).
+			Str("path", r.URL.RequestURI()).
+			Str("remoteAddr", r.RemoteAddr).
+			Int("status", response.Status()).
+			Dur("took", time.Since(started)).
+			Msg("Served request")
+	})
+}
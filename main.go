@@ -4,20 +4,33 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	stdlog "log"
-
 	"github.com/alecthomas/kingpin"
-	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+	"github.com/clwilliams/tlWatchFolderAggregator/auth"
+	"github.com/clwilliams/tlWatchFolderAggregator/cache"
+	"github.com/clwilliams/tlWatchFolderAggregator/changes"
+	"github.com/clwilliams/tlWatchFolderAggregator/compression"
+	"github.com/clwilliams/tlWatchFolderAggregator/consumer"
+	"github.com/clwilliams/tlWatchFolderAggregator/cors"
 	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
 	"github.com/clwilliams/tlWatchFolderAggregator/internal"
-	"github.com/gorilla/handlers"
+	"github.com/clwilliams/tlWatchFolderAggregator/journal"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/clwilliams/tlWatchFolderAggregator/metrics"
+	"github.com/clwilliams/tlWatchFolderAggregator/openapi"
+	"github.com/clwilliams/tlWatchFolderAggregator/ratelimit"
+	"github.com/clwilliams/tlWatchFolderAggregator/tracing"
+	"github.com/clwilliams/tlWatchFolderAggregator/watcher"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	log "github.com/rs/zerolog/log"
-
-	"net/http"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -28,15 +41,45 @@ const (
 	defaultRabbitMqExchange   = "thirdlight"
 	defaultRabbitMqQueue      = "watcher"
 	defaultRabbitMqRoutingKey = "crud"
+	defaultSource             = "rabbitmq"
+	defaultNatsURL            = "nats://localhost:4222"
+	defaultNatsStream         = "thirdlight"
+	defaultKafkaBrokers       = "localhost:9092"
 	defaultEsURL              = "http://localhost:9200"
 	defaultEsIndex            = "tl-watch"
 	defaultAPIPort            = "3001"
+	defaultAPIReadTimeout     = "30000"
+	defaultAPIHeaderTimeout   = "10000"
+	defaultAPIWriteTimeout    = "60000"
+	defaultAPIIdleTimeout     = "120000"
 	defaultHandlerTimeout     = "50000"
+	defaultReconnectDelay     = "500"
+	defaultMaxReconnectDelay  = "30000"
+	defaultWorkers            = "1"
+	defaultPrefetch           = "3"
+	defaultJournalSegmentSize = "64"
+	defaultTraceExporter      = "none"
+	defaultTraceSampleRatio   = "1"
+	defaultLogFormat          = "auto"
+	defaultCORSAllowedOrigins = "*"
+	defaultCORSAllowedMethods = "GET, POST"
+	defaultCORSAllowedHeaders = "Origin, Content-Type, Authorization, X-API-Key, X-Request-ID, X-Correlation-ID, If-None-Match, If-Modified-Since"
+	defaultCORSExposedHeaders = "X-Total-Count, X-Request-ID, ETag, Retry-After"
+	defaultCORSMaxAge         = "1728000"
+	defaultRateLimit          = "0"
+	defaultRateLimitProxies   = "1"
+	defaultListingCacheSize   = "0"
 )
 
 var (
+	serveCmd  = kingpin.Command("serve", "Consume folder watch messages into ElasticSearch & serve the REST API").Default()
+	replayCmd = kingpin.Command("replay", "Rebuild the ElasticSearch index from the journal")
+
+	configFile         = kingpin.Flag("config", "YAML file declaring the RabbitMQ bindings, replaces the single queue / routing key flags").Short('c').Envar("CONFIG_FILE").String()
+	source             = kingpin.Flag("source", "Message broker to consume from").Envar("SOURCE").Default(defaultSource).Enum("rabbitmq", "nats", "kafka")
 	dev                = kingpin.Flag("dev", "Run app in development mode, no-dev for production").Default("true").Envar("DEV").Bool()
 	verbose            = kingpin.Flag("verbose", "Enable verbose mode").Envar("VERBOSE").Bool()
+	logFormat          = kingpin.Flag("log-format", "Log output format, auto is console in development mode & json otherwise").Envar("LOG_FORMAT").Default(defaultLogFormat).Enum("auto", "json", "console")
 	rabbitMqHost       = kingpin.Flag("rabbit-mq-host", "").Envar("RABBITMQ_HOST").Default(defaultRabbitMqHost).String()
 	rabbitMqPort       = kingpin.Flag("rabbit-mq-port", "").Envar("RABBITMQ_PORT").Default(defaultRabbitMqPort).String()
 	rabbitMqUser       = kingpin.Flag("rabbit-mq-user", "").Envar("RABBITMQ_USER").Default(defaultRabbitMqUser).String()
@@ -44,138 +87,434 @@ var (
 	rabbitMqExchange   = kingpin.Flag("rabbit-mq-exchange", "").Envar("RABBITMQ_EXCHANGE").Default(defaultRabbitMqExchange).String()
 	rabbitMqQueue      = kingpin.Flag("rabbit-mq-queue", "").Envar("RABBITMQ_QUEUE").Default(defaultRabbitMqQueue).String()
 	rabbitMqRoutingKey = kingpin.Flag("rabbit-mq-routing-key", "").Envar("RABBITMQ_ROUTING_KEY").Default(defaultRabbitMqRoutingKey).String()
-	elasticURL         = kingpin.Flag("es-url", "ElasticSearch URL").Short('u').Envar("ES_URL").Default(defaultEsURL).String()
+	elasticURL         = kingpin.Flag("es-url", "ElasticSearch URL, comma separate to give several nodes").Short('u').Envar("ES_URL").Default(defaultEsURL).String()
+	elasticUser        = kingpin.Flag("es-user", "ElasticSearch basic auth username").Envar("ES_USER").String()
+	elasticPassword    = kingpin.Flag("es-password", "ElasticSearch basic auth password").Envar("ES_PASSWORD").String()
+	elasticAPIKey      = kingpin.Flag("es-api-key", "ElasticSearch API key (base64 encoded id:key)").Envar("ES_API_KEY").String()
+	elasticCACert      = kingpin.Flag("es-ca-cert", "PEM file of the CA used to verify ElasticSearch").Envar("ES_CA_CERT").String()
+	elasticClientCert  = kingpin.Flag("es-client-cert", "PEM client certificate for ElasticSearch").Envar("ES_CLIENT_CERT").String()
+	elasticClientKey   = kingpin.Flag("es-client-key", "PEM client key for ElasticSearch").Envar("ES_CLIENT_KEY").String()
+	elasticInsecure    = kingpin.Flag("es-insecure", "Skip verification of the ElasticSearch certificate").Envar("ES_INSECURE").Bool()
+	elasticSniff       = kingpin.Flag("es-sniff", "Enable ElasticSearch node sniffing").Envar("ES_SNIFF").Bool()
+	elasticHealthcheck = kingpin.Flag("es-healthcheck", "Enable ElasticSearch node health checks").Envar("ES_HEALTHCHECK").Bool()
 	elasticIndex       = kingpin.Flag("es-index", "ElasticSearch index").Short('i').Envar("ES_INDEX").Default(defaultEsIndex).String()
 	apiPort            = kingpin.Flag("api-port", "REST API port").Envar("API_PORT").Short('a').Default(defaultAPIPort).String()
 	handlerTimeout     = kingpin.Flag("handler-timeout", "Timeout in milliseconds for message handler").Default(defaultHandlerTimeout).Int()
+
+	rabbitMqReconnectDelay    = kingpin.Flag("rabbit-mq-reconnect-delay", "Initial delay in milliseconds before reconnecting to RabbitMQ").Envar("RABBITMQ_RECONNECT_DELAY").Default(defaultReconnectDelay).Int()
+	rabbitMqMaxReconnectDelay = kingpin.Flag("rabbit-mq-max-reconnect-delay", "Maximum delay in milliseconds between RabbitMQ reconnection attempts").Envar("RABBITMQ_MAX_RECONNECT_DELAY").Default(defaultMaxReconnectDelay).Int()
+	rabbitMqWorkers           = kingpin.Flag("rabbit-mq-workers", "Number of messages processed concurrently from the queue").Envar("RABBITMQ_WORKERS").Default(defaultWorkers).Int()
+	rabbitMqPrefetch          = kingpin.Flag("rabbit-mq-prefetch", "Number of unacknowledged messages RabbitMQ will deliver ahead of processing").Envar("RABBITMQ_PREFETCH").Default(defaultPrefetch).Int()
+
+	natsURL      = kingpin.Flag("nats-url", "NATS server URL, when the source is nats").Envar("NATS_URL").Default(defaultNatsURL).String()
+	natsUser     = kingpin.Flag("nats-user", "NATS username").Envar("NATS_USER").String()
+	natsPassword = kingpin.Flag("nats-password", "NATS password").Envar("NATS_PASSWORD").String()
+	natsToken    = kingpin.Flag("nats-token", "NATS authentication token").Envar("NATS_TOKEN").String()
+	natsStream   = kingpin.Flag("nats-stream", "JetStream stream to consume from").Envar("NATS_STREAM").Default(defaultNatsStream).String()
+	kafkaBrokers = kingpin.Flag("kafka-brokers", "Comma separated Kafka broker addresses, when the source is kafka").Envar("KAFKA_BROKERS").Default(defaultKafkaBrokers).String()
+
+	watchFolders = kingpin.Flag("watch", "Watch a folder on the local filesystem instead of consuming from a broker, repeat for several").Envar("WATCH_FOLDERS").Strings()
+	ingestTokens = kingpin.Flag("ingest-tokens", "Comma separated bearer tokens accepted by POST /events/ingest, the endpoint is disabled without any").Envar("INGEST_TOKENS").String()
+
+	apiAuthFile = kingpin.Flag("api-auth-file", "YAML file declaring how API callers are authenticated & the paths they may see, the API is open without one").Envar("API_AUTH_FILE").String()
+	apiTLSCert  = kingpin.Flag("api-tls-cert", "PEM certificate to serve the REST API over TLS with").Envar("API_TLS_CERT").String()
+	apiTLSKey   = kingpin.Flag("api-tls-key", "PEM key for --api-tls-cert").Envar("API_TLS_KEY").String()
+	apiClientCA = kingpin.Flag("api-client-ca", "PEM file of the CA client certificates are verified against, when serving over TLS").Envar("API_CLIENT_CA").String()
+
+	apiHTTP2             = kingpin.Flag("api-http2", "Serve HTTP/2 to clients that support it, when serving over TLS").Envar("API_HTTP2").Default("true").Bool()
+	apiH2C               = kingpin.Flag("api-h2c", "Accept HTTP/2 over plain HTTP (h2c), when not serving over TLS").Envar("API_H2C").Bool()
+	apiReadTimeout       = kingpin.Flag("api-read-timeout", "Timeout in milliseconds for reading a whole API request").Envar("API_READ_TIMEOUT").Default(defaultAPIReadTimeout).Int()
+	apiReadHeaderTimeout = kingpin.Flag("api-read-header-timeout", "Timeout in milliseconds for reading an API request's headers").Envar("API_READ_HEADER_TIMEOUT").Default(defaultAPIHeaderTimeout).Int()
+	apiWriteTimeout      = kingpin.Flag("api-write-timeout", "Timeout in milliseconds for writing an API response").Envar("API_WRITE_TIMEOUT").Default(defaultAPIWriteTimeout).Int()
+	apiIdleTimeout       = kingpin.Flag("api-idle-timeout", "Timeout in milliseconds for keep-alive connections waiting for the next request").Envar("API_IDLE_TIMEOUT").Default(defaultAPIIdleTimeout).Int()
+	apiCompression       = kingpin.Flag("api-compression", "Compress API responses with brotli or gzip, when the caller accepts them").Envar("API_COMPRESSION").Default("true").Bool()
+	apiSocket            = kingpin.Flag("api-socket", "Also serve the REST API on this unix socket").Envar("API_SOCKET").String()
+
+	grpcPort       = kingpin.Flag("grpc-port", "Port to serve the gRPC API on, over TLS like the REST API, it isn't served without one").Envar("GRPC_PORT").String()
+	grpcReflection = kingpin.Flag("grpc-reflection", "Serve gRPC reflection, so tools such as grpcurl can discover the gRPC API").Envar("GRPC_REFLECTION").Default("true").Bool()
+
+	corsAllowedOrigins   = kingpin.Flag("cors-allowed-origins", "Comma separated origins allowed to call the REST API from a browser, * for any, or with a wildcard e.g. https://*.example.com").Envar("CORS_ALLOWED_ORIGINS").Default(defaultCORSAllowedOrigins).String()
+	corsAllowedMethods   = kingpin.Flag("cors-allowed-methods", "Comma separated methods allowed in cross origin requests").Envar("CORS_ALLOWED_METHODS").Default(defaultCORSAllowedMethods).String()
+	corsAllowedHeaders   = kingpin.Flag("cors-allowed-headers", "Comma separated request headers allowed in cross origin requests, * for any").Envar("CORS_ALLOWED_HEADERS").Default(defaultCORSAllowedHeaders).String()
+	corsExposedHeaders   = kingpin.Flag("cors-exposed-headers", "Comma separated response headers cross origin callers may read").Envar("CORS_EXPOSED_HEADERS").Default(defaultCORSExposedHeaders).String()
+	corsAllowCredentials = kingpin.Flag("cors-allow-credentials", "Allow credentials to be sent with cross origin requests").Envar("CORS_ALLOW_CREDENTIALS").Bool()
+	corsMaxAge           = kingpin.Flag("cors-max-age", "Seconds browsers may cache preflight responses for").Envar("CORS_MAX_AGE").Default(defaultCORSMaxAge).Int()
+
+	rateLimit             = kingpin.Flag("rate-limit", "Requests per second each client may make to each API route, as <rate>[:<burst>], 0 for unlimited").Envar("RATE_LIMIT").Default(defaultRateLimit).String()
+	rateLimitRoutes       = kingpin.Flag("rate-limit-route", "Rate limit for a route, overriding --rate-limit, as <route>=<rate>[:<burst>] e.g. /all=1:5, repeat for several").Envar("RATE_LIMIT_ROUTES").Strings()
+	rateLimitForwardedFor = kingpin.Flag("rate-limit-forwarded-for", "Identify clients without credentials by their X-Forwarded-For address, when the API is behind a proxy").Envar("RATE_LIMIT_FORWARDED_FOR").Bool()
+	rateLimitProxies      = kingpin.Flag("rate-limit-trusted-proxies", "How many trusted proxies are in front of the API, with --rate-limit-forwarded-for. The client's address is taken that many from the right of X-Forwarded-For").Envar("RATE_LIMIT_TRUSTED_PROXIES").Default(defaultRateLimitProxies).Int()
+
+	listingCacheSize = kingpin.Flag("listing-cache-size", "Number of recent folder listings to cache in memory, 0 disables the cache").Envar("LISTING_CACHE_SIZE").Default(defaultListingCacheSize).Int()
+
+	journalDir         = kingpin.Flag("journal-dir", "Directory to journal every processed message in, so the index can be rebuilt with replay").Envar("JOURNAL_DIR").String()
+	journalSegmentSize = kingpin.Flag("journal-segment-size", "Size in megabytes at which a new journal segment file is started").Envar("JOURNAL_SEGMENT_SIZE").Default(defaultJournalSegmentSize).Int64()
+
+	traceExporter    = kingpin.Flag("trace-exporter", "Where to export OpenTelemetry spans to").Envar("TRACE_EXPORTER").Default(defaultTraceExporter).Enum("none", "otlp", "stdout")
+	otlpEndpoint     = kingpin.Flag("otlp-endpoint", "OTLP/HTTP collector host:port, when the trace exporter is otlp").Envar("OTLP_ENDPOINT").String()
+	otlpInsecure     = kingpin.Flag("otlp-insecure", "Send spans to the OTLP collector over plain HTTP").Envar("OTLP_INSECURE").Bool()
+	traceSampleRatio = kingpin.Flag("trace-sample-ratio", "Proportion of traces started by the aggregator that are sampled").Envar("TRACE_SAMPLE_RATIO").Default(defaultTraceSampleRatio).Float64()
 )
 
 func init() {
 	// Only log the warning severity or above.
-	log.Level(zerolog.WarnLevel)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
 }
 
-func server(esApp *elasticSearch.App) {
+// server - serves the REST API, & the gRPC API when there's a port for it.
+// The first consumer is the one consuming from the broker, any others are
+// reported by the readiness & status endpoints. Returns once the context is
+// cancelled & the requests in flight are finished with
+func server(ctx context.Context, esApp *elasticSearch.App, listings *cache.Listings, feed *changes.Feed, consumers []*consumer.Consumer, reload func() error, ingester *internal.Ingester, authenticator *auth.Auth, errorCount func() int64) {
 	router := mux.NewRouter()
+	router.Use(logging.LogRequests, tracing.TraceRoutes, metrics.InstrumentRoutes, internal.RecoverPanics)
+	limiter, err := rateLimiter()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid rate limit")
+	}
+	if limiter != nil {
+		trustedProxies := 0
+		if *rateLimitForwardedFor {
+			if *rateLimitProxies < 1 {
+				log.Fatal().Int("proxies", *rateLimitProxies).Msg("There must be at least 1 trusted proxy to take addresses from X-Forwarded-For")
+			}
+			trustedProxies = *rateLimitProxies
+		}
+		// probes & scrapes aren't limited. Requests are limited before
+		// they're authenticated, so failing to is limited too
+		router.Use(internal.LimitRate(limiter, authenticator, trustedProxies,
+			"/health", "/healthz", "/readyz", "/metrics"))
+	}
+	if authenticator != nil {
+		// probes, scrapes & the docs stay open, ingest requests have their own
+		// tokens
+		router.Use(internal.Authenticate(authenticator,
+			"/health", "/healthz", "/readyz", "/metrics", "/events/ingest", "/events/ingest/{id}",
+			openapi.DocumentPath, openapi.UIPath))
+	}
+	router.NotFoundHandler = logging.LogRequests(internal.NotFound())
+	router.MethodNotAllowedHandler = logging.LogRequests(internal.MethodNotAllowed())
 
 	// routes we're going to handle
-	router.Handle("/all", internal.GetAll(esApp)).Methods("GET")
-	router.Handle("/watch", internal.GetFsNodesForWatchFolder(esApp)).Methods("GET")
+	store := internal.CachedStore(esApp, listings)
+	router.Handle("/all", internal.GetAll(store, listings)).Methods("GET")
+	router.Handle("/watch", internal.GetFsNodesForWatchFolder(store, listings)).Methods("GET")
+	router.Handle("/list", internal.GetList(store, listings)).Methods("GET")
+	router.Handle("/health", internal.GetHealth(consumers[0])).Methods("GET")
+	router.Handle("/healthz", internal.GetHealthz()).Methods("GET")
+	router.Handle("/readyz", internal.GetReadyz(esApp, consumers)).Methods("GET")
+	router.Handle("/status", internal.GetStatus(esApp, consumers, errorCount)).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	if authenticator != nil {
+		// without authentication there's no telling who's an admin
+		router.Handle("/admin/reload", internal.PostReload(reload)).Methods("POST")
+	}
+	router.Handle("/graphql", internal.PostGraphQL(store)).Methods("POST")
+	if ingester != nil {
+		router.Handle("/events/ingest", internal.PostIngest(ingester)).Methods("POST")
+		router.Handle("/events/ingest/{id}", internal.GetIngest(ingester)).Methods("GET")
+	}
+	// the document describes the routes registered above, so must come last
+	document, err := openapi.Document(router)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to describe the REST API")
+	}
+	router.Handle(openapi.DocumentPath, openapi.Handler(document)).Methods("GET")
+	router.Handle(openapi.UIPath, openapi.UI()).Methods("GET")
+
+	// cross origin requests are checked before they're routed
+	corsOptions := cors.Options{
+		AllowedOrigins:   splitList(*corsAllowedOrigins),
+		AllowedMethods:   splitList(*corsAllowedMethods),
+		AllowedHeaders:   splitList(*corsAllowedHeaders),
+		ExposedHeaders:   splitList(*corsExposedHeaders),
+		AllowCredentials: *corsAllowCredentials,
+		MaxAge:           *corsMaxAge,
+	}
+	if err := corsOptions.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid CORS settings")
+	}
+	handler := cors.Handler(corsOptions, router)
+	if *apiCompression {
+		handler = compression.Handler(handler)
+	}
+
+	var grpcServer *grpc.Server
+	if *grpcPort != "" {
+		options, err := grpcOptions()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up the gRPC API")
+		}
+		grpcServer = internal.NewGRPCServer(store, feed, authenticator, *grpcReflection, log.Logger, options...)
+	}
+	if err := serve(ctx, handler, grpcServer); err != nil {
+		log.Fatal().Err(err).Msg("Failed to serve the REST API")
+	}
+}
+
+// rateLimiter - the limiter for the rate limit flags, nil when nothing is
+// limited
+func rateLimiter() (*ratelimit.Limiter, error) {
+	defaultLimit, err := ratelimit.ParseLimit(*rateLimit)
+	if err != nil {
+		return nil, err
+	}
+	limited := !defaultLimit.Unlimited()
+	routes := map[string]ratelimit.Limit{}
+	for _, routeLimit := range *rateLimitRoutes {
+		parts := strings.SplitN(routeLimit, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("Invalid route rate limit %q, give <route>=<rate>[:<burst>]", routeLimit)
+		}
+		limit, err := ratelimit.ParseLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		routes[parts[0]] = limit
+		limited = limited || !limit.Unlimited()
+	}
+	if !limited {
+		return nil, nil
+	}
+	return ratelimit.New(defaultLimit, routes), nil
+}
 
-	host := fmt.Sprintf(":%s", *apiPort)
-	log.Printf("Listening on %s...\n", host)
-	loggedRouter := handlers.LoggingHandler(os.Stdout, router)
-	stdlog.Fatal(http.ListenAndServe(":8000", loggedRouter))
+// splitList - splits a comma separated flag value, dropping any empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// messageSource - the broker the aggregator consumes messages from, or the
+// in-process source when watching the local filesystem
+func messageSource(local *consumer.Channel, logger zerolog.Logger) consumer.Source {
+	if len(*watchFolders) > 0 {
+		return local
+	}
+	switch *source {
+	case "nats":
+		return &consumer.NATS{
+			URL:      *natsURL,
+			User:     *natsUser,
+			Password: *natsPassword,
+			Token:    *natsToken,
+			Stream:   *natsStream,
+			Logger:   logger,
+		}
+	case "kafka":
+		return &consumer.Kafka{Brokers: splitList(*kafkaBrokers), Logger: logger}
+	default:
+		return &consumer.RabbitMQ{
+			Host:     *rabbitMqHost,
+			Port:     *rabbitMqPort,
+			User:     *rabbitMqUser,
+			Password: *rabbitMqPassword,
+			Exchange: *rabbitMqExchange,
+			Logger:   logger,
+		}
+	}
 }
 
 func main() {
 	// parse the command line arguments
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	// Initialise Logging
 	// by default set to warn level
-	// if we're in development mode, default to info level
+	// if we're in development mode, default to info level & console output
 	// if the verbose flag is set, set to the verbose level
+	format := *logFormat
+	if format == "auto" {
+		format = "json"
+		if *dev {
+			format = "console"
+		}
+	}
+	// the logger's given to each package, the main package logging through
+	// the global logger which is the same one
+	logger := logging.New(format)
+	log.Logger = logger
 	if *dev {
-		log.Level(zerolog.InfoLevel)
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
-	stdlog.SetFlags(0)
-	stdlog.SetOutput(log.Logger)
 
 	if *verbose {
-		log.Level(zerolog.DebugLevel)
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 		log.Debug().Msg("Set logging to verbose")
 	}
+	flagLogLevel = zerolog.GlobalLevel()
+
+	shutdownTracing, err := tracing.Setup(tracing.Options{
+		Exporter:    *traceExporter,
+		Endpoint:    *otlpEndpoint,
+		Insecure:    *otlpInsecure,
+		SampleRatio: *traceSampleRatio,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up tracing")
+	}
+	defer shutdownTracing(context.Background())
 
 	// initialise connection to elastic search, which will also ensure the index
 	// that we want to use exixts. If not it will create it
-	esApp, err := elasticSearch.Connect(*verbose, *elasticURL, *elasticIndex)
+	esApp, err := elasticSearch.Connect(*verbose, *elasticIndex, elasticSearch.Options{
+		URLs:               splitList(*elasticURL),
+		Username:           *elasticUser,
+		Password:           *elasticPassword,
+		APIKey:             *elasticAPIKey,
+		CACertFile:         *elasticCACert,
+		ClientCertFile:     *elasticClientCert,
+		ClientKeyFile:      *elasticClientKey,
+		InsecureSkipVerify: *elasticInsecure,
+		Sniff:              *elasticSniff,
+		Healthcheck:        *elasticHealthcheck,
+		Logger:             logger,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to connect to ElasticSearch")
 	}
 	defer esApp.Client.Stop()
 
-	// Initialise Rabbit MQ
-	rabbitMQClient := rabbitMQ.MessageClient{}
-	err = rabbitMQClient.Connect(rabbitMqHost, rabbitMqPort, rabbitMqUser, rabbitMqPassword)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to connect to RabbitMQ")
-	}
-	defer rabbitMQClient.Connection.Close()
-
-	// configure the RabbitMQ channel and exchange
-	err = rabbitMQClient.ConfigureChannelAndExchange(rabbitMqExchange)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to configure RabbitMQ Channel / Exchange")
+	if command == replayCmd.FullCommand() {
+		if err := replay(esApp); err != nil {
+			log.Fatal().Err(err).Msg("Failed to replay the journal")
+		}
+		return
 	}
-	defer rabbitMQClient.Channel.Close()
 
 	// create an error channel to receive any errors when processing the messages
 	errLog := make(chan error)
 	defer close(errLog)
 
-	type bind struct {
-		queue   string
-		key     string
-		handler func(context.Context, []byte) error
+	// configure the queue / routing keys to a message handler, either from the
+	// config file or the single binding given on the command line
+	// the handlers bump the generation of the index listings are served at,
+	// & feed the changes they apply to those watching over gRPC
+	if *listingCacheSize < 0 {
+		log.Fatal().Int("size", *listingCacheSize).Msg("The listing cache size can't be negative")
 	}
-
-	// configure the queue / routing key to a message handler
-	// (potential to configure many if needed)
-	for _, binding := range []bind{
-		{*rabbitMqQueue, *rabbitMqRoutingKey, internal.HandleFolderWatchUpdate(esApp)},
-	} {
-		if _, err := rabbitMQClient.Channel.QueueDeclare(binding.queue, true, false, false, false, nil); err != nil {
-			log.Error().Err(err).Str(binding.queue, binding.queue).Msg("Problem declaring queue")
+	listings := cache.New(*listingCacheSize)
+	feed := changes.New()
+	messageHandlers := internal.MessageHandlers(esApp, listings, feed)
+	if *journalDir != "" {
+		messageJournal, err := journal.Open(*journalDir, *journalSegmentSize<<20)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the journal")
 		}
-		if err := rabbitMQClient.Channel.QueueBind(binding.queue, binding.key, *rabbitMqExchange, false, nil); err != nil {
-			log.Error().Err(err).Str(binding.queue, binding.queue).Msg("Problem binding")
+		defer messageJournal.Close()
+		for name, handler := range messageHandlers {
+			handler.Handle = messageJournal.Record(name, handler.Handle, func(err error) { errLog <- err })
+			messageHandlers[name] = handler
 		}
-		if err := rabbitMQClient.Channel.Qos(3, 0, false); err != nil {
-			log.Error().Err(err).Msg("Problem setting QOS")
+	}
+	cfg, bindings, err := loadConfig(messageHandlers)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	applyLogLevel(cfg)
+	if *rabbitMqReconnectDelay < 1 || *rabbitMqMaxReconnectDelay < *rabbitMqReconnectDelay {
+		log.Fatal().Int("delay", *rabbitMqReconnectDelay).Int("maxDelay", *rabbitMqMaxReconnectDelay).
+			Msg("The reconnect delay must be at least 1ms, & no more than the max reconnect delay")
+	}
+	localSource := consumer.NewChannel()
+	messageConsumer := consumer.New(consumer.Config{
+		HandlerTimeout:    defaultHandlerTimeoutFor(cfg),
+		ReconnectDelay:    time.Duration(*rabbitMqReconnectDelay) * time.Millisecond,
+		MaxReconnectDelay: time.Duration(*rabbitMqMaxReconnectDelay) * time.Millisecond,
+		Logger:            logger,
+	}, messageSource(localSource, logger), bindings, errLog)
+
+	// the consumer keeps (re)connecting to the broker until the context is
+	// cancelled, on SIGTERM or an interrupt
+	ctx, cancel := signal.NotifyContext(logging.WithLogger(context.Background(), logger), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	var consuming sync.WaitGroup
+	run := func(c *consumer.Consumer) {
+		consuming.Add(1)
+		go func() {
+			defer consuming.Done()
+			c.Run(ctx)
+		}()
+	}
+	run(messageConsumer)
+	consumers := []*consumer.Consumer{messageConsumer}
+
+	metrics.RegisterQueueLag(messageConsumer.QueueLag)
+	metrics.RegisterIndexDocuments(esApp.Index, func() (int64, error) {
+		return esApp.Count(context.Background())
+	}, logger)
+	metrics.RegisterChangeWatchers(feed.Subscribers)
+
+	// the config file is reloaded on SIGHUP, or a POST to /admin/reload
+	reload := reloader(messageHandlers, messageConsumer)
+	go reloadOnSignal(reload)
+
+	// changes to the watch folders are published on the in-process source
+	if len(*watchFolders) > 0 {
+		folderWatcher := &watcher.Watcher{
+			Folders: *watchFolders,
+			Send: func(ctx context.Context, msg []byte) error {
+				return localSource.PublishWhenSubscribed(ctx, watchRoutingKey, msg)
+			},
 		}
-		deliveries, err := rabbitMQClient.Channel.Consume(binding.queue, "", false, false, false, false, nil)
-		if err != nil {
-			log.Error().Err(err).Str(binding.queue, binding.queue).Msg("Problem setting consumer for")
-		}
-
-		// start a thread for the queue / handler
-		go func(binding bind) {
-			// listen for messages being delivered
-			for delivery := range deliveries {
-				log.Printf("Reading on %v", binding.queue)
-				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*handlerTimeout)*time.Millisecond)
-				if err := binding.handler(ctx, delivery.Body); err != nil {
-					// there has been an error processing the message
-					log.Printf("ErrLogging")
-					// add to the error log
-					errLog <- err
-					// and negatively acknowledge message processing
-					if err := delivery.Nack(false, false); err != nil {
-						errLog <- err
-					}
-					log.Printf("Aborting %v", binding.queue)
-				}
-				// successfully processed message - acknowledge
-				if err := delivery.Ack(false); err != nil {
-					errLog <- err
-				}
-				// release resources if slowOperation completes before timeout elapses
-				cancel()
+		go func() {
+			if err := folderWatcher.Run(ctx); err != nil {
+				log.Fatal().Err(err).Msg("Failed to watch the local filesystem")
 			}
-		}(binding)
+		}()
 	}
 
+	// messages posted to the API are run through the folder watch handler via
+	// the in-process source, which is only being consumed already when watching
+	var ingester *internal.Ingester
+	if tokens := splitList(*ingestTokens); len(tokens) > 0 {
+		if len(*watchFolders) == 0 {
+			ingestConsumer := consumer.New(consumer.Config{
+				HandlerTimeout: defaultHandlerTimeoutFor(cfg),
+				Logger:         logger,
+			}, localSource, []consumer.Binding{localBinding(messageHandlers)}, errLog)
+			run(ingestConsumer)
+			consumers = append(consumers, ingestConsumer)
+		}
+		ingester = internal.NewIngester(localSource, tokens)
+	}
+
+	var errorCount int64
 	go func() {
-		log.Printf("reading error log")
 		for err := range errLog {
-			log.Error().Err(err).Msg("ERROR :")
+			atomic.AddInt64(&errorCount, 1)
+			metrics.Errors.Inc()
+			log.Error().Err(err).Msg("Error reported")
 		}
 	}()
-	log.Printf("waiting...")
-	log.Printf("done.")
 
-	// Lastly initialise the router so we can serve API requests
-	server(esApp)
+	// API requests are only authenticated when there's an auth file
+	var authenticator *auth.Auth
+	if *apiAuthFile != "" {
+		authConfig, err := auth.Load(*apiAuthFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load the API auth file")
+		}
+		if authConfig.ClientCerts && (*apiTLSCert == "" || *apiClientCA == "") {
+			log.Fatal().Msg("Client certificates can only be accepted when serving over TLS, give --api-tls-cert & --api-client-ca")
+		}
+		if authenticator, err = auth.New(authConfig); err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up API authentication")
+		}
+	}
+
+	// Lastly initialise the router so we can serve API requests, until asked
+	// to stop. The messages being handled are then finished with before the
+	// journal's closed
+	server(ctx, esApp, listings, feed, consumers, reload, ingester, authenticator, func() int64 {
+		return atomic.LoadInt64(&errorCount)
+	})
+	log.Info().Msg("Shutting down")
+	cancel()
+	consuming.Wait()
 }
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/recorder"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const namespace = "tl_watch_folder_aggregator"
+
+var (
+	// FolderWatchMessages - folder watch messages processed, by action &
+	// outcome
+	FolderWatchMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "folder_watch_messages_total",
+		Help:      "Folder watch messages processed, by action & outcome.",
+	}, []string{"action", "outcome"})
+
+	// FolderWatchDuration - how long folder watch messages take to process,
+	// by action
+	FolderWatchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "folder_watch_duration_seconds",
+		Help:      "Time taken to process a folder watch message, by action.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"action"})
+
+	// Deliveries - messages delivered by the source, by binding & whether
+	// they were acknowledged or rejected
+	Deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_total",
+		Help:      "Messages delivered by the source, by binding & outcome (ack / nack).",
+	}, []string{"binding", "outcome"})
+
+	// HandlerDuration - how long the binding's handler takes per message
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken by the binding's handler to process a message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"binding"})
+
+	// InFlight - messages delivered to the binding, but not yet acknowledged
+	InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deliveries_in_flight",
+		Help:      "Messages delivered to the binding but not yet acknowledged.",
+	}, []string{"binding"})
+
+	// Prefetch - the number of unacknowledged messages the binding allows
+	Prefetch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "prefetch",
+		Help:      "Unacknowledged messages the broker may deliver to the binding.",
+	}, []string{"binding"})
+
+	// Errors - errors sent to the error log
+	Errors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Errors reported whilst processing messages.",
+	})
+
+	// ElasticSearchRequests - how long requests to ElasticSearch take, by
+	// method & status code
+	ElasticSearchRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "elasticsearch_request_duration_seconds",
+		Help:      "Time taken by requests to ElasticSearch, by method & status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	// HTTPRequests - how long API requests take, by route, method & status code
+	HTTPRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve API requests, by route, method & status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	// RateLimited - API requests rejected for exceeding the rate limit, by route
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_rate_limited_total",
+		Help:      "API requests rejected for exceeding the client's rate limit, by route.",
+	}, []string{"route"})
+
+	// GRPCRequests - how long gRPC calls take, by method & status code.
+	// Streams are timed until they end
+	GRPCRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Time taken to serve gRPC calls, by method & status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	// ListingCache - folder listings looked up in the listing cache, by
+	// whether they were found
+	ListingCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "listing_cache_requests_total",
+		Help:      "Folder listings looked up in the listing cache, by result (hit / miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		FolderWatchMessages,
+		FolderWatchDuration,
+		Deliveries,
+		HandlerDuration,
+		InFlight,
+		Prefetch,
+		Errors,
+		ElasticSearchRequests,
+		HTTPRequests,
+		RateLimited,
+		GRPCRequests,
+		ListingCache,
+	)
+}
+
+// Handler - serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Outcome - the outcome label for an error
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// RegisterQueueLag - reports the messages waiting on each binding's queue,
+// which are looked up whenever the metrics are scraped
+func RegisterQueueLag(lag func() map[string]int64) {
+	prometheus.MustRegister(&queueLagCollector{lag: lag})
+}
+
+// RegisterIndexDocuments - reports the number of documents in the index,
+// which is counted whenever the metrics are scraped. Failures to count are
+// logged to the logger
+func RegisterIndexDocuments(index string, count func() (int64, error), logger zerolog.Logger) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "index_documents",
+		Help:        "Documents in the ElasticSearch index.",
+		ConstLabels: prometheus.Labels{"index": index},
+	}, func() float64 {
+		documents, err := count()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to count the index documents for metrics")
+			return 0
+		}
+		return float64(documents)
+	}))
+}
+
+// RegisterChangeWatchers - reports how many are watching the changes to the
+// index, as they're counted when the metrics are scraped
+func RegisterChangeWatchers(count func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "change_watchers",
+		Help:      "Callers watching the changes applied to the index.",
+	}, func() float64 {
+		return float64(count())
+	}))
+}
+
+var queueLagDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "queue_lag"),
+	"Messages waiting on the binding's queue to be delivered.",
+	[]string{"binding"}, nil,
+)
+
+// queueLagCollector - asks the consumer for its queues' lag on each scrape
+type queueLagCollector struct {
+	lag func() map[string]int64
+}
+
+func (c *queueLagCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- queueLagDesc
+}
+
+func (c *queueLagCollector) Collect(metrics chan<- prometheus.Metric) {
+	for binding, lag := range c.lag() {
+		metrics <- prometheus.MustNewConstMetric(queueLagDesc, prometheus.GaugeValue, float64(lag), binding)
+	}
+}
+
+// InstrumentRoutes - router middleware recording how long each request takes,
+// labelled by its route's path template rather than the path requested
+func InstrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		response := recorder.New(w)
+		started := time.Now()
+		next.ServeHTTP(response, r)
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(response.Status())).
+			Observe(time.Since(started).Seconds())
+	})
+}
+
+// InstrumentElasticSearch - records how long each request made to ElasticSearch
+// through the transport takes
+func InstrumentElasticSearch(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		started := time.Now()
+		resp, err := next.RoundTrip(r)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		ElasticSearchRequests.WithLabelValues(r.Method, code).Observe(time.Since(started).Seconds())
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
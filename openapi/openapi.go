@@ -0,0 +1,120 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// where the document & its UI are served, they're always described
+const (
+	DocumentPath = "/openapi.json"
+	UIPath       = "/docs"
+)
+
+// specification - every operation the API can serve, some of which are only
+// registered when enabled. The client package is generated from it
+//
+//go:embed openapi.json
+var specification []byte
+
+// Document - the OpenAPI document for the routes registered on the router, &
+// the document & its UI. A registered route the specification doesn't
+// describe is an error, so the two can't drift apart
+func Document(router *mux.Router) ([]byte, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(specification, &document); err != nil {
+		return nil, fmt.Errorf("Invalid OpenAPI specification %v", err)
+	}
+	paths, _ := document["paths"].(map[string]interface{})
+
+	registered := map[string]bool{
+		"GET " + DocumentPath: true,
+		"GET " + UIPath:       true,
+	}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return fmt.Errorf("Route %s must be restricted to its methods to be described", template)
+		}
+		for _, method := range methods {
+			registered[method+" "+template] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var undescribed []string
+	for operation := range registered {
+		parts := strings.SplitN(operation, " ", 2)
+		item, _ := paths[parts[1]].(map[string]interface{})
+		if _, ok := item[strings.ToLower(parts[0])]; !ok {
+			undescribed = append(undescribed, operation)
+		}
+	}
+	if len(undescribed) > 0 {
+		sort.Strings(undescribed)
+		return nil, fmt.Errorf("The OpenAPI specification doesn't describe %s", strings.Join(undescribed, ", "))
+	}
+
+	// only what's served is described, e.g. not ingesting when it's disabled
+	for path, item := range paths {
+		operations := item.(map[string]interface{})
+		for method := range operations {
+			if !registered[strings.ToUpper(method)+" "+path] {
+				delete(operations, method)
+			}
+		}
+		if len(operations) == 0 {
+			delete(paths, path)
+		}
+	}
+	return json.Marshal(document)
+}
+
+// Handler - serves the document
+func Handler(document []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	})
+}
+
+// UI - serves Swagger UI for the document, its assets being loaded from the
+// swagger-ui-dist package on unpkg
+func UI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(uiPage))
+	})
+}
+
+// uiPage - the document is fetched relative to the page, so it still works
+// behind a proxy serving the API under a prefix
+const uiPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>tlWatchFolderAggregator API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "` + "." + DocumentPath + `", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval - how often buckets that have refilled are dropped, so
+// clients that have gone away don't hold on to memory
+const sweepInterval = time.Minute
+
+// maxBuckets - the most buckets kept, however many clients turn up between
+// sweeps. Past it the least recently used are dropped, those clients
+// starting again with a full bucket
+const maxBuckets = 100000
+
+// Limit - the requests per second a client may make, & how many of them can
+// be made at once. A rate of 0 is unlimited
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit - parses a limit of <requests per second>[:<burst>], the burst
+// defaulting to a second's worth of requests
+func ParseLimit(value string) (Limit, error) {
+	rate, burst := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		rate, burst = value[:i], value[i+1:]
+	}
+	limit := Limit{}
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || limit.Rate < 0 {
+		return Limit{}, fmt.Errorf("Invalid rate limit %q, give <requests per second>[:<burst>]", value)
+	}
+	if burst == "" {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	} else if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || limit.Burst < 1 {
+		return Limit{}, fmt.Errorf("Invalid rate limit burst %q, it must be at least 1", value)
+	}
+	return limit, nil
+}
+
+// Unlimited - whether the limit doesn't limit anything
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Limiter - a token bucket for each client of each route
+type Limiter struct {
+	defaultLimit Limit
+	routes       map[string]Limit
+	maxBuckets   int
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*list.Element
+	// used orders the buckets, most recently used first
+	used  *list.List
+	swept time.Time
+}
+
+type bucketKey struct {
+	route, client string
+}
+
+type bucket struct {
+	key    bucketKey
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// New - a limiter applying the routes' limits, & the default limit to any
+// other route
+func New(defaultLimit Limit, routes map[string]Limit) *Limiter {
+	return &Limiter{
+		defaultLimit: defaultLimit,
+		routes:       routes,
+		maxBuckets:   maxBuckets,
+		buckets:      map[bucketKey]*list.Element{},
+		used:         list.New(),
+		swept:        time.Now(),
+	}
+}
+
+// LimitFor - the limit applied to the route
+func (l *Limiter) LimitFor(route string) Limit {
+	if limit, ok := l.routes[route]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// Allow - takes a token from the client's bucket for the route. Without one
+// to take, the request isn't allowed & it's how long until there will be
+func (l *Limiter) Allow(route, client string) (bool, time.Duration) {
+	limit := l.LimitFor(route)
+	if limit.Unlimited() {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+	b := l.bucket(bucketKey{route: route, client: client}, limit, now)
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// bucket - the bucket for the key, a full one when it's new. Must be called
+// holding the lock
+func (l *Limiter) bucket(key bucketKey, limit Limit, now time.Time) *bucket {
+	if element, ok := l.buckets[key]; ok {
+		l.used.MoveToFront(element)
+		return element.Value.(*bucket)
+	}
+	if len(l.buckets) >= l.maxBuckets {
+		l.drop(l.used.Back())
+	}
+	b := &bucket{key: key, limit: limit, tokens: float64(limit.Burst), last: now}
+	l.buckets[key] = l.used.PushFront(b)
+	return b
+}
+
+// sweep - drops the buckets that would be full, as they're no different to a
+// new bucket
+func (l *Limiter) sweep(now time.Time) {
+	for _, element := range l.buckets {
+		b := element.Value.(*bucket)
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			l.drop(element)
+		}
+	}
+	l.swept = now
+}
+
+func (l *Limiter) drop(element *list.Element) {
+	delete(l.buckets, element.Value.(*bucket).key)
+	l.used.Remove(element)
+}
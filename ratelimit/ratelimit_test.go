@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	for value, want := range map[string]Limit{
+		"5":     {Rate: 5, Burst: 5},
+		"0.5":   {Rate: 0.5, Burst: 1},
+		"5:20":  {Rate: 5, Burst: 20},
+		" 2 :3": {Rate: 2, Burst: 3},
+		"0":     {Rate: 0, Burst: 1},
+	} {
+		if got, err := ParseLimit(value); err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %+v %v, want %+v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "fast", "-1", "5:0", "5:lots"} {
+		if _, err := ParseLimit(value); err == nil {
+			t.Errorf("ParseLimit(%q) was valid", value)
+		}
+	}
+}
+
+func TestAllowLimitsEachClientOfEachRoute(t *testing.T) {
+	limiter := New(Limit{Rate: 1, Burst: 2}, map[string]Limit{"/open": {}})
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("/all", "a"); !allowed {
+			t.Fatalf("Request %d within the burst wasn't allowed", i+1)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("/all", "a")
+	if allowed || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("Past the burst gave %t, retry after %v, want refused for up to a second", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.Allow("/all", "b"); !allowed {
+		t.Error("Another client was limited")
+	}
+	if allowed, _ := limiter.Allow("/watch", "a"); !allowed {
+		t.Error("Another route was limited")
+	}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := limiter.Allow("/open", "a"); !allowed {
+			t.Fatal("An unlimited route was limited")
+		}
+	}
+}
+
+func TestBucketsAreBounded(t *testing.T) {
+	limiter := New(Limit{Rate: 1, Burst: 1}, nil)
+	limiter.maxBuckets = 3
+	for i := 0; i < 10; i++ {
+		limiter.Allow("/all", fmt.Sprintf("client%d", i))
+	}
+	if len(limiter.buckets) != 3 || limiter.used.Len() != 3 {
+		t.Fatalf("Kept %d buckets, want 3", len(limiter.buckets))
+	}
+	// the most recently used are kept
+	if allowed, _ := limiter.Allow("/all", "client9"); allowed {
+		t.Error("The most recent client's bucket was dropped")
+	}
+	if allowed, _ := limiter.Allow("/all", "client0"); !allowed {
+		t.Error("The least recent client's bucket was kept")
+	}
+}
+
+func TestSweepDropsFullBuckets(t *testing.T) {
+	limiter := New(Limit{Rate: 1, Burst: 1}, nil)
+	limiter.Allow("/all", "a")
+	limiter.Allow("/all", "b")
+	limiter.sweep(time.Now().Add(2 * time.Second))
+	if len(limiter.buckets) != 0 || limiter.used.Len() != 0 {
+		t.Errorf("Kept %d buckets that had refilled", len(limiter.buckets))
+	}
+}
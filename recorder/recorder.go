@@ -0,0 +1,74 @@
+package recorder
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Recorder - wraps a response, remembering the status written to it. The
+// response's flushing & hijacking are passed through, as is anything else a
+// http.ResponseController asks of it
+type Recorder struct {
+	http.ResponseWriter
+	status  int
+	started bool
+}
+
+// New - records the response written to w
+func New(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status - the status written, 200 when it was left to the first write
+func (r *Recorder) Status() int {
+	return r.status
+}
+
+// Started - whether the response has been started, so it's too late to
+// change the status
+func (r *Recorder) Started() bool {
+	return r.started
+}
+
+func (r *Recorder) WriteHeader(status int) {
+	if !r.started {
+		r.status = status
+	}
+	// informational responses come before the real one
+	r.started = r.started || status >= http.StatusOK
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *Recorder) Write(data []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush - passes flushes on, for responses that are streamed
+func (r *Recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.started = true
+		flusher.Flush()
+	}
+}
+
+// Hijack - hands over the connection, for protocols that take it over such
+// as websockets. The status is recorded as switching protocols
+func (r *Recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		r.status, r.started = http.StatusSwitchingProtocols, true
+	}
+	return conn, rw, err
+}
+
+// Unwrap - the response being recorded, for http.ResponseController
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
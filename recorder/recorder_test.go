@@ -0,0 +1,68 @@
+package recorder
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hijackable - a response whose connection can be taken over
+type hijackable struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackable) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestRecordsTheStatusWritten(t *testing.T) {
+	response := New(httptest.NewRecorder())
+	if response.Status() != http.StatusOK || response.Started() {
+		t.Errorf("Status %d, started %t before writing, want 200 & not started", response.Status(), response.Started())
+	}
+	response.WriteHeader(http.StatusEarlyHints)
+	response.WriteHeader(http.StatusNotFound)
+	response.WriteHeader(http.StatusInternalServerError)
+	if response.Status() != http.StatusNotFound || !response.Started() {
+		t.Errorf("Status %d, started %t, want the first final status 404", response.Status(), response.Started())
+	}
+}
+
+func TestWritingStartsTheResponse(t *testing.T) {
+	response := New(httptest.NewRecorder())
+	response.Write([]byte("{}"))
+	if response.Status() != http.StatusOK || !response.Started() {
+		t.Errorf("Status %d, started %t, want 200 & started", response.Status(), response.Started())
+	}
+}
+
+func TestHijackingIsPassedOn(t *testing.T) {
+	underlying := &hijackable{ResponseRecorder: httptest.NewRecorder()}
+	var w http.ResponseWriter = New(underlying)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatal("The recorder can't be hijacked")
+	}
+	if _, _, err := hijacker.Hijack(); err != nil || !underlying.hijacked {
+		t.Errorf("Hijacking gave %v, want the response hijacked", err)
+	}
+	if status := w.(*Recorder).Status(); status != http.StatusSwitchingProtocols {
+		t.Errorf("Status %d once hijacked, want 101", status)
+	}
+
+	if _, _, err := New(httptest.NewRecorder()).Hijack(); err == nil {
+		t.Error("Hijacked a response that can't be")
+	}
+}
+
+func TestResponseControllerReachesTheResponse(t *testing.T) {
+	underlying := httptest.NewRecorder()
+	controller := http.NewResponseController(New(underlying))
+	if err := controller.Flush(); err != nil || !underlying.Flushed {
+		t.Errorf("Flushing gave %v, want the response flushed", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/config"
+	"github.com/clwilliams/tlWatchFolderAggregator/consumer"
+	"github.com/clwilliams/tlWatchFolderAggregator/internal"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+)
+
+// flagLogLevel - the log level given by the command line arguments, used
+// unless the config file sets its own
+var flagLogLevel zerolog.Level
+
+// watchRoutingKey - the routing key the local watcher's messages are
+// published with on the in-process source
+const watchRoutingKey = "watch"
+
+// loadConfig - reads the config file & the bindings to consume. When watching
+// the local filesystem nothing's consumed from the broker, so the only binding
+// is for the in-process source
+func loadConfig(handlers map[string]internal.MessageHandler) (*config.Config, []consumer.Binding, error) {
+	cfg, bindings, err := loadBrokerConfig(handlers)
+	if err != nil || len(*watchFolders) == 0 {
+		return cfg, bindings, err
+	}
+	return cfg, []consumer.Binding{localBinding(handlers)}, nil
+}
+
+// localBinding - runs messages published on the in-process source, by the
+// ingest endpoint or the local watcher, through the folder watch handler
+func localBinding(handlers map[string]internal.MessageHandler) consumer.Binding {
+	handler := handlers[internal.FolderWatchHandler]
+	return consumer.Binding{
+		Name:         "local",
+		HandlerName:  internal.FolderWatchHandler,
+		Queue:        "local",
+		RoutingKeys:  []string{internal.IngestRoutingKey, watchRoutingKey},
+		Handler:      handler.Handle,
+		Workers:      *rabbitMqWorkers,
+		PartitionKey: handler.PartitionKey,
+	}
+}
+
+// loadBrokerConfig - reads the config file & the queue bindings it declares.
+// When there isn't a config file the config is nil, and the single binding is
+// given by the command line arguments
+func loadBrokerConfig(handlers map[string]internal.MessageHandler) (*config.Config, []consumer.Binding, error) {
+	if *configFile == "" {
+		handler := handlers[internal.FolderWatchHandler]
+		return nil, []consumer.Binding{
+			{
+				Name:         *rabbitMqQueue,
+				HandlerName:  internal.FolderWatchHandler,
+				Queue:        *rabbitMqQueue,
+				RoutingKeys:  []string{*rabbitMqRoutingKey},
+				Durable:      true,
+				Handler:      handler.Handle,
+				Workers:      *rabbitMqWorkers,
+				Prefetch:     *rabbitMqPrefetch,
+				PartitionKey: handler.PartitionKey,
+			},
+		}, nil
+	}
+
+	var handlerNames []string
+	for name := range handlers {
+		handlerNames = append(handlerNames, name)
+	}
+	sort.Strings(handlerNames)
+	cfg, err := config.Load(*configFile, handlerNames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bindings []consumer.Binding
+	for _, binding := range cfg.Bindings {
+		handler := handlers[binding.Handler]
+		workers, prefetch := binding.Workers, binding.Prefetch
+		if workers == 0 {
+			workers = *rabbitMqWorkers
+		}
+		if prefetch == 0 {
+			prefetch = *rabbitMqPrefetch
+		}
+		bindings = append(bindings, consumer.Binding{
+			Name:         binding.Name,
+			HandlerName:  binding.Handler,
+			Exchange:     binding.Exchange,
+			ExchangeType: binding.ExchangeType,
+			Queue:        binding.Queue,
+			RoutingKeys:  binding.RoutingKeys,
+			Durable:      binding.IsDurable(),
+			AutoDelete:   binding.AutoDelete,
+			Arguments:    binding.QueueArguments(),
+			Handler:      handler.Handle,
+			Timeout:      binding.Timeout,
+			Workers:      workers,
+			Prefetch:     prefetch,
+			PartitionKey: handler.PartitionKey,
+		})
+	}
+	return cfg, bindings, nil
+}
+
+// applyLogLevel - sets the log level from the config file, or back to the one
+// from the command line arguments when the file doesn't set one
+func applyLogLevel(cfg *config.Config) {
+	level := flagLogLevel
+	if cfg != nil && cfg.LogLevel != "" {
+		// already validated when the config was loaded
+		level, _ = zerolog.ParseLevel(cfg.LogLevel)
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// defaultHandlerTimeoutFor - the handler timeout for bindings without their
+// own, from the config file or the command line arguments
+func defaultHandlerTimeoutFor(cfg *config.Config) time.Duration {
+	if cfg != nil && cfg.HandlerTimeout > 0 {
+		return cfg.HandlerTimeout
+	}
+	return time.Duration(*handlerTimeout) * time.Millisecond
+}
+
+// reloader - returns a function that re-reads the config file and applies it
+// to the running aggregator. Should the file be invalid nothing is changed
+func reloader(handlers map[string]internal.MessageHandler, messageConsumer *consumer.Consumer) func() error {
+	var mu sync.Mutex
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if *configFile == "" {
+			return errors.New("There isn't a config file to reload, start with --config")
+		}
+		cfg, bindings, err := loadConfig(handlers)
+		if err != nil {
+			return err
+		}
+		applyLogLevel(cfg)
+		return messageConsumer.Update(bindings, defaultHandlerTimeoutFor(cfg))
+	}
+}
+
+// reloadOnSignal - reloads the config file whenever the process receives a
+// SIGHUP
+func reloadOnSignal(reload func() error) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload configuration")
+			continue
+		}
+		log.Info().Str("config", *configFile).Msg("Reloaded configuration")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/elasticSearch"
+	"github.com/clwilliams/tlWatchFolderAggregator/internal"
+	"github.com/clwilliams/tlWatchFolderAggregator/journal"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	log "github.com/rs/zerolog/log"
+)
+
+var (
+	replayUntil     = replayCmd.Flag("until", "Only replay messages journalled up to this time (RFC 3339)").String()
+	replayOverwrite = replayCmd.Flag("overwrite", "Delete the index before replaying, should it already hold documents").Bool()
+)
+
+// replay - rebuilds the index from the journal, passing each message to the
+// handler that originally processed it. Messages that fail are reported, but
+// don't stop the replay
+func replay(esApp *elasticSearch.App) error {
+	if *journalDir == "" {
+		return errors.New("There isn't a journal to replay, give --journal-dir")
+	}
+	var until time.Time
+	if *replayUntil != "" {
+		var err error
+		if until, err = time.Parse(time.RFC3339, *replayUntil); err != nil {
+			return fmt.Errorf("Can't parse --until %v", err)
+		}
+	}
+
+	// the index must start empty, otherwise replaying could resurrect
+	// documents that have since been deleted
+	count, err := esApp.Count(context.Background())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		if !*replayOverwrite {
+			return fmt.Errorf("Index %s already holds %d documents, give --overwrite to replace them", esApp.Index, count)
+		}
+		log.Warn().Str("index", esApp.Index).Int64("documents", count).Msg("Deleting index before replaying")
+		if err := esApp.ResetIndex(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	// the handlers aren't journalled, the messages are already in the journal
+	handlers := internal.MessageHandlers(esApp, nil, nil)
+	timeout := time.Duration(*handlerTimeout) * time.Millisecond
+	failed := 0
+	started := time.Now()
+	err = journal.Replay(*journalDir, until, func(entry journal.Entry) error {
+		handler, ok := handlers[entry.Handler]
+		if !ok {
+			failed++
+			log.Error().Str("handler", entry.Handler).Msg("Journalled message's handler no longer exists")
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), log.Logger), timeout)
+		defer cancel()
+		if err := handler.Handle(ctx, entry.Body); err != nil {
+			failed++
+			log.Error().Err(err).Time("journalled", entry.Time).Msg("Failed to replay message")
+		}
+		return nil
+	}, func(progress journal.Progress) {
+		log.Info().
+			Str("segment", progress.Segment).
+			Int("messages", progress.Entries).
+			Int("failed", failed).
+			Str("progress", fmt.Sprintf("%.1f%%", progress.Percent())).
+			Msg("Replaying journal")
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Int("failed", failed).Dur("took", time.Since(started)).Msg("Replay complete")
+	return nil
+}
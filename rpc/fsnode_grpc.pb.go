@@ -0,0 +1,293 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: fsnode.proto
+
+// The file index, served over gRPC alongside the REST API for services that
+// would rather call typed RPCs. Only the nodes the caller may see are ever
+// returned
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	FsNodes_ListNodes_FullMethodName    = "/tlwatchfolder.v1.FsNodes/ListNodes"
+	FsNodes_GetNode_FullMethodName      = "/tlwatchfolder.v1.FsNodes/GetNode"
+	FsNodes_Search_FullMethodName       = "/tlwatchfolder.v1.FsNodes/Search"
+	FsNodes_WatchChanges_FullMethodName = "/tlwatchfolder.v1.FsNodes/WatchChanges"
+)
+
+// FsNodesClient is the client API for FsNodes service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FsNodesClient interface {
+	// Every node within the folder, or in the index when no folder is given,
+	// ordered by path. They're sent as they're scrolled from ElasticSearch
+	ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (FsNodes_ListNodesClient, error)
+	// The file or folder at the path
+	GetNode(ctx context.Context, in *GetNodeRequest, opts ...grpc.CallOption) (*FsNode, error)
+	// A page of the nodes whose name contains the text, ignoring case
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
+	// The changes applied to the index from now on, within the folder when
+	// given. A watcher that falls behind is sent RESOURCE_EXHAUSTED, & should
+	// list the nodes again before watching from then
+	WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (FsNodes_WatchChangesClient, error)
+}
+
+type fsNodesClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFsNodesClient(cc grpc.ClientConnInterface) FsNodesClient {
+	return &fsNodesClient{cc}
+}
+
+func (c *fsNodesClient) ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (FsNodes_ListNodesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FsNodes_ServiceDesc.Streams[0], FsNodes_ListNodes_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fsNodesListNodesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FsNodes_ListNodesClient interface {
+	Recv() (*FsNode, error)
+	grpc.ClientStream
+}
+
+type fsNodesListNodesClient struct {
+	grpc.ClientStream
+}
+
+func (x *fsNodesListNodesClient) Recv() (*FsNode, error) {
+	m := new(FsNode)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fsNodesClient) GetNode(ctx context.Context, in *GetNodeRequest, opts ...grpc.CallOption) (*FsNode, error) {
+	out := new(FsNode)
+	err := c.cc.Invoke(ctx, FsNodes_GetNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fsNodesClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	out := new(SearchResponse)
+	err := c.cc.Invoke(ctx, FsNodes_Search_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fsNodesClient) WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (FsNodes_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FsNodes_ServiceDesc.Streams[1], FsNodes_WatchChanges_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fsNodesWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FsNodes_WatchChangesClient interface {
+	Recv() (*Change, error)
+	grpc.ClientStream
+}
+
+type fsNodesWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *fsNodesWatchChangesClient) Recv() (*Change, error) {
+	m := new(Change)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FsNodesServer is the server API for FsNodes service.
+// All implementations must embed UnimplementedFsNodesServer
+// for forward compatibility
+type FsNodesServer interface {
+	// Every node within the folder, or in the index when no folder is given,
+	// ordered by path. They're sent as they're scrolled from ElasticSearch
+	ListNodes(*ListNodesRequest, FsNodes_ListNodesServer) error
+	// The file or folder at the path
+	GetNode(context.Context, *GetNodeRequest) (*FsNode, error)
+	// A page of the nodes whose name contains the text, ignoring case
+	Search(context.Context, *SearchRequest) (*SearchResponse, error)
+	// The changes applied to the index from now on, within the folder when
+	// given. A watcher that falls behind is sent RESOURCE_EXHAUSTED, & should
+	// list the nodes again before watching from then
+	WatchChanges(*WatchChangesRequest, FsNodes_WatchChangesServer) error
+	mustEmbedUnimplementedFsNodesServer()
+}
+
+// UnimplementedFsNodesServer must be embedded to have forward compatible implementations.
+type UnimplementedFsNodesServer struct {
+}
+
+func (UnimplementedFsNodesServer) ListNodes(*ListNodesRequest, FsNodes_ListNodesServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListNodes not implemented")
+}
+func (UnimplementedFsNodesServer) GetNode(context.Context, *GetNodeRequest) (*FsNode, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNode not implemented")
+}
+func (UnimplementedFsNodesServer) Search(context.Context, *SearchRequest) (*SearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
+func (UnimplementedFsNodesServer) WatchChanges(*WatchChangesRequest, FsNodes_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedFsNodesServer) mustEmbedUnimplementedFsNodesServer() {}
+
+// UnsafeFsNodesServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FsNodesServer will
+// result in compilation errors.
+type UnsafeFsNodesServer interface {
+	mustEmbedUnimplementedFsNodesServer()
+}
+
+func RegisterFsNodesServer(s grpc.ServiceRegistrar, srv FsNodesServer) {
+	s.RegisterService(&FsNodes_ServiceDesc, srv)
+}
+
+func _FsNodes_ListNodes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListNodesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FsNodesServer).ListNodes(m, &fsNodesListNodesServer{stream})
+}
+
+type FsNodes_ListNodesServer interface {
+	Send(*FsNode) error
+	grpc.ServerStream
+}
+
+type fsNodesListNodesServer struct {
+	grpc.ServerStream
+}
+
+func (x *fsNodesListNodesServer) Send(m *FsNode) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FsNodes_GetNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FsNodesServer).GetNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FsNodes_GetNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FsNodesServer).GetNode(ctx, req.(*GetNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FsNodes_Search_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FsNodesServer).Search(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FsNodes_Search_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FsNodesServer).Search(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FsNodes_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FsNodesServer).WatchChanges(m, &fsNodesWatchChangesServer{stream})
+}
+
+type FsNodes_WatchChangesServer interface {
+	Send(*Change) error
+	grpc.ServerStream
+}
+
+type fsNodesWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *fsNodesWatchChangesServer) Send(m *Change) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// FsNodes_ServiceDesc is the grpc.ServiceDesc for FsNodes service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FsNodes_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tlwatchfolder.v1.FsNodes",
+	HandlerType: (*FsNodesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetNode",
+			Handler:    _FsNodes_GetNode_Handler,
+		},
+		{
+			MethodName: "Search",
+			Handler:    _FsNodes_Search_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListNodes",
+			Handler:       _FsNodes_ListNodes_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _FsNodes_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "fsnode.proto",
+}
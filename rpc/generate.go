@@ -0,0 +1,5 @@
+package rpc
+
+// The messages & service are generated from fsnode.proto, so regenerate them
+// whenever it changes, with protoc-gen-go v1.31.0 & protoc-gen-go-grpc v1.3.0
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fsnode.proto
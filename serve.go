@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	log "github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// certCheckInterval - how often the certificate files are checked for
+// changes, at most, as TLS connections are made
+const certCheckInterval = 10 * time.Second
+
+// shutdownTimeout - how long the requests in flight are given to finish when
+// shutting down, before their connections are closed
+const shutdownTimeout = 10 * time.Second
+
+// grpcKeepalive - how long a gRPC connection may be idle before it's
+// pinged, so proxies don't drop those only watching for changes
+const grpcKeepalive = time.Minute
+
+// serve - serves the API on its port, over TLS when there's a certificate,
+// and on the unix socket when there's one. The gRPC API is served on its own
+// port, when there's a server for it. Only returns once a listener fails, or
+// the context is cancelled & the servers have been shut down
+func serve(ctx context.Context, handler http.Handler, grpcServer *grpc.Server) error {
+	errs := make(chan error, 3)
+	var httpServers []*http.Server
+
+	if grpcServer != nil {
+		grpcAddress := fmt.Sprintf(":%s", *grpcPort)
+		grpcListener, err := net.Listen("tcp", grpcAddress)
+		if err != nil {
+			return fmt.Errorf("Can't listen on %s %v", grpcAddress, err)
+		}
+		log.Info().Str("address", grpcAddress).Bool("tls", *apiTLSCert != "").Msg("Listening for gRPC")
+		go func() { errs <- grpcServer.Serve(grpcListener) }()
+	}
+
+	if *apiSocket != "" {
+		listener, err := listenUnix(*apiSocket)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		// the socket is only reachable locally, so is always plain HTTP
+		log.Info().Str("socket", *apiSocket).Msg("Listening")
+		socketServer := newHTTPServer(handler)
+		httpServers = append(httpServers, socketServer)
+		go func() { errs <- socketServer.Serve(listener) }()
+	}
+
+	address := fmt.Sprintf(":%s", *apiPort)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Can't listen on %s %v", address, err)
+	}
+	httpServer := newHTTPServer(handler)
+	httpServers = append(httpServers, httpServer)
+	if *apiTLSCert == "" {
+		if *apiH2C {
+			httpServer.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: httpServer.IdleTimeout})
+		}
+		log.Info().Str("address", address).Bool("h2c", *apiH2C).Msg("Listening")
+		go func() { errs <- httpServer.Serve(listener) }()
+	} else {
+		if httpServer.TLSConfig, err = apiTLSConfig(); err != nil {
+			return err
+		}
+		if !*apiHTTP2 {
+			// a non-nil map stops HTTP/2 being negotiated
+			httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		log.Info().Str("address", address).Bool("http2", *apiHTTP2).Bool("clientCerts", *apiClientCA != "").Msg("Listening over TLS")
+		go func() { errs <- httpServer.ServeTLS(listener, "", "") }()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown(httpServers, grpcServer)
+	return nil
+}
+
+// shutdown - stops the servers accepting connections & waits for the
+// requests in flight, for up to the shutdown timeout. Those still going
+// then, such as exports or gRPC watches, have their connections closed
+func shutdown(httpServers []*http.Server, grpcServer *grpc.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var stopped sync.WaitGroup
+	if grpcServer != nil {
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			graceful := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(graceful)
+			}()
+			select {
+			case <-graceful:
+			case <-ctx.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+	for _, httpServer := range httpServers {
+		stopped.Add(1)
+		go func(httpServer *http.Server) {
+			defer stopped.Done()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Msg("Requests were still in flight when shutting down")
+				httpServer.Close()
+			}
+		}(httpServer)
+	}
+	stopped.Wait()
+}
+
+// newHTTPServer - a server for the handler, with the configured timeouts.
+// Requests are logged to the global logger
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return logging.WithLogger(context.Background(), log.Logger)
+		},
+		ReadTimeout:       time.Duration(*apiReadTimeout) * time.Millisecond,
+		ReadHeaderTimeout: time.Duration(*apiReadHeaderTimeout) * time.Millisecond,
+		WriteTimeout:      time.Duration(*apiWriteTimeout) * time.Millisecond,
+		IdleTimeout:       time.Duration(*apiIdleTimeout) * time.Millisecond,
+	}
+}
+
+// grpcOptions - the gRPC server's options, serving over TLS with the REST
+// API's certificate & client CA when there's one
+func grpcOptions() ([]grpc.ServerOption, error) {
+	options := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: grpcKeepalive}),
+	}
+	if *apiTLSCert == "" {
+		return options, nil
+	}
+	tlsConfig, err := apiTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return append(options, grpc.Creds(credentials.NewTLS(tlsConfig))), nil
+}
+
+// listenUnix - listens on the unix socket, replacing any left behind by a
+// previous run. Only the owner & group may connect
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Can't remove the old socket %s %v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on socket %s %v", path, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Can't set the permissions of socket %s %v", path, err)
+	}
+	return listener, nil
+}
+
+// apiTLSConfig - the TLS settings the API is served with. Client certificates
+// are asked for when there's a client CA, but not required so callers can
+// still authenticate in other ways
+func apiTLSConfig() (*tls.Config, error) {
+	certs, err := newCertReloader(*apiTLSCert, *apiTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}
+	if *apiClientCA == "" {
+		return tlsConfig, nil
+	}
+	caCert, err := ioutil.ReadFile(*apiClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read client CA file %s %v", *apiClientCA, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in client CA file %s", *apiClientCA)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// certReloader - serves the certificate, reloading it when its files change
+// so a renewed certificate is used without restarting. Should the new files
+// be invalid, the previous certificate carries on being served
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	modified, err := lastModified(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Can't load TLS certificate %s %v", certFile, err)
+	}
+	return &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		cert:     &cert,
+		modified: modified,
+		checked:  time.Now(),
+	}, nil
+}
+
+// GetCertificate - the certificate to serve, checking for changes first if
+// it's been a while
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		c.reloadIfChanged()
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) reloadIfChanged() {
+	modified, err := lastModified(c.certFile, c.keyFile)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check the TLS certificate for changes")
+		return
+	}
+	if modified.Equal(c.modified) {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// the files may be part way through being replaced, try again later
+		log.Error().Err(err).Str("cert", c.certFile).Msg("Failed to reload the TLS certificate, still serving the previous one")
+		return
+	}
+	c.cert, c.modified = &cert, modified
+	log.Info().Str("cert", c.certFile).Msg("Reloaded the TLS certificate")
+}
+
+// lastModified - when the most recently modified of the files was modified
+func lastModified(files ...string) (time.Time, error) {
+	var modified time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Can't read TLS file %s %v", file, err)
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/clwilliams/tlWatchFolderAggregator/recorder"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName - the name the aggregator's spans are reported under
+const ServiceName = "tlWatchFolderAggregator"
+
+// Options - where spans are exported to
+type Options struct {
+	// Exporter is one of none, otlp or stdout
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector's host:port, defaults to the
+	// exporter's own (OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318)
+	Endpoint string
+	// Insecure sends spans to the collector over plain HTTP
+	Insecure bool
+	// SampleRatio is the proportion of traces started here that are sampled,
+	// traces started upstream follow the upstream decision
+	SampleRatio float64
+}
+
+// Setup - installs the tracer provider & the W3C trace context propagator,
+// returning a function that flushes any spans not yet exported. With the none
+// exporter spans are still propagated, but never recorded
+func Setup(opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		var clientOptions []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			clientOptions = append(clientOptions, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), clientOptions...)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter %s", opts.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the %s trace exporter %v", opts.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer - the tracer for the named package, it follows whichever provider
+// Setup installs
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("github.com/clwilliams/tlWatchFolderAggregator/" + name)
+}
+
+// Extract - the context carrying the trace propagated in the headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// Inject - the headers propagating the context's trace
+func Inject(ctx context.Context) map[string]string {
+	headers := map[string]string{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	return headers
+}
+
+// End - records the error, if there is one, on the span & ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceRoutes - router middleware starting a span for each request, named by
+// its route's path template & continuing any trace propagated by the caller
+func TraceRoutes(next http.Handler) http.Handler {
+	tracer := Tracer("api")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.RequestURI()),
+			))
+		defer span.End()
+
+		response := recorder.New(w)
+		next.ServeHTTP(response, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", response.Status()))
+		if response.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(response.Status()))
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+	"github.com/clwilliams/tlWatchFolderAggregator/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultRenameWindow - how long a file renamed out of a folder is held,
+// waiting for it to appear under its new name, before it's taken as deleted
+const DefaultRenameWindow = 100 * time.Millisecond
+
+// Watcher - watches folders on the local filesystem, sending a folder watch
+// message for every change as tlWatchFolder would. Every file & folder
+// already in the watch folders is sent as created when it starts
+type Watcher struct {
+	Folders []string
+	// Send is given each message in the order the changes were made, and is
+	// expected to have processed it before returning
+	Send         func(context.Context, []byte) error
+	RenameWindow time.Duration
+
+	fsWatcher *fsnotify.Watcher
+	// nodes is every file / folder being watched, as it was when first seen,
+	// so the two halves of a rename can be matched up as the same file
+	nodes map[string]os.FileInfo
+	// renamed are the paths renamed, but not yet seen under their new names
+	renamed []renamedNode
+}
+
+// renamedNode - the old half of a rename, waiting for the new half
+type renamedNode struct {
+	path string
+	info os.FileInfo
+	at   time.Time
+}
+
+// Run - scans the watch folders then sends their changes, until the context
+// is cancelled
+func (w *Watcher) Run(ctx context.Context) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Failed to start watching the filesystem %v", err)
+	}
+	defer fsWatcher.Close()
+	w.fsWatcher = fsWatcher
+	w.nodes = map[string]os.FileInfo{}
+	if w.RenameWindow <= 0 {
+		w.RenameWindow = DefaultRenameWindow
+	}
+
+	for i, folder := range w.Folders {
+		if w.Folders[i], err = filepath.Abs(folder); err != nil {
+			return fmt.Errorf("Failed to resolve watch folder %s %v", folder, err)
+		}
+	}
+	for _, folder := range w.Folders {
+		info, err := os.Stat(folder)
+		if err != nil {
+			return fmt.Errorf("Failed to watch folder %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Watch folder %s isn't a folder", folder)
+		}
+		logging.Ctx(ctx).Info().Str("folder", folder).Msg("Scanning watch folder")
+		w.scan(ctx, folder)
+	}
+
+	ticker := time.NewTicker(w.RenameWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(ctx, event)
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return nil
+			}
+			logging.Ctx(ctx).Error().Err(err).Msg("Problem watching the filesystem")
+		case <-ticker.C:
+			w.expireRenames(ctx, time.Now().Add(-w.RenameWindow))
+		}
+	}
+}
+
+// scan - sends every file & folder under the path as created, watching the
+// folders for changes. Anything already known is skipped, so it's safe to
+// rescan a folder whose contents may only be partly known
+func (w *Watcher) scan(ctx context.Context, root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// it's been removed since it was listed, there'll be an event for it
+			return nil
+		}
+		if info.IsDir() {
+			if err := w.fsWatcher.Add(path); err != nil {
+				logging.Ctx(ctx).Error().Err(err).Str("folder", path).Msg("Failed to watch folder")
+			}
+		}
+		if _, known := w.nodes[path]; !known {
+			w.nodes[path] = info
+			w.send(ctx, rabbitMQ.CreateAction, path, info.IsDir())
+		}
+		return nil
+	})
+}
+
+// handleEvent - turns the filesystem event into folder watch messages. A
+// rename is reported as the old path being renamed, followed by the new path
+// being created, so the two are paired up when they're the same file. Writes
+// & permission changes aren't of interest
+func (w *Watcher) handleEvent(ctx context.Context, event fsnotify.Event) {
+	path := event.Name
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		info, err := os.Lstat(path)
+		if err != nil {
+			// it's already gone again, there'll be an event for that
+			return
+		}
+		if renamed, ok := w.pairRename(info); ok {
+			w.rename(ctx, renamed, path, info)
+			return
+		}
+		if info.IsDir() {
+			// anything created in the folder before it was watched is picked up
+			// by the scan
+			w.scan(ctx, path)
+			return
+		}
+		if _, known := w.nodes[path]; !known {
+			w.nodes[path] = info
+			w.send(ctx, rabbitMQ.CreateAction, path, false)
+		}
+	case event.Op&fsnotify.Rename == fsnotify.Rename:
+		if info, known := w.nodes[path]; known {
+			w.renamed = append(w.renamed, renamedNode{path: path, info: info, at: time.Now()})
+		}
+	case event.Op&fsnotify.Remove == fsnotify.Remove:
+		if info, known := w.nodes[path]; known {
+			w.forget(path, info.IsDir())
+			w.send(ctx, rabbitMQ.DeleteAction, path, info.IsDir())
+		}
+	}
+}
+
+// pairRename - finds the rename the created file is the new half of, by it
+// being the same file (its inode on unix). Anything else created whilst a
+// rename is waiting is unrelated, so is left to be sent as created, & the
+// rename as deleted should nothing turn up for it
+func (w *Watcher) pairRename(info os.FileInfo) (renamedNode, bool) {
+	for i, renamed := range w.renamed {
+		if os.SameFile(renamed.info, info) {
+			w.renamed = append(w.renamed[:i], w.renamed[i+1:]...)
+			return renamed, true
+		}
+	}
+	return renamedNode{}, false
+}
+
+// rename - sends the rename / move, re-watching a folder at its new path. The
+// handler moves a folder's contents along with it, so they aren't sent
+func (w *Watcher) rename(ctx context.Context, renamed renamedNode, path string, info os.FileInfo) {
+	action := rabbitMQ.RenameAction
+	if filepath.Dir(renamed.path) != filepath.Dir(path) {
+		action = rabbitMQ.MoveAction
+	}
+	isDir := renamed.info.IsDir()
+	w.forget(renamed.path, isDir)
+	w.nodes[path] = info
+	w.send(ctx, action, renamed.path+" -> "+path, isDir)
+	if isDir {
+		// the folder's contents are known under the new path from now on
+		w.markKnown(path)
+		w.scan(ctx, path)
+	}
+}
+
+// markKnown - records everything under the folder, without sending anything
+func (w *Watcher) markKnown(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path != root {
+			w.nodes[path] = info
+		}
+		return nil
+	})
+}
+
+// expireRenames - anything renamed before the cutoff without appearing
+// elsewhere has been moved out of the watch folders, so it's deleted
+func (w *Watcher) expireRenames(ctx context.Context, cutoff time.Time) {
+	var pending []renamedNode
+	for _, renamed := range w.renamed {
+		if renamed.at.After(cutoff) {
+			pending = append(pending, renamed)
+			continue
+		}
+		w.forget(renamed.path, renamed.info.IsDir())
+		w.send(ctx, rabbitMQ.DeleteAction, renamed.path, renamed.info.IsDir())
+	}
+	w.renamed = pending
+}
+
+// forget - stops tracking the path, and for a folder everything in it. The
+// handler deletes or moves a folder's contents along with it, so nothing is
+// sent for them
+func (w *Watcher) forget(path string, isDir bool) {
+	delete(w.nodes, path)
+	if !isDir {
+		return
+	}
+	w.fsWatcher.Remove(path)
+	prefix := path + string(filepath.Separator)
+	for known, knownInfo := range w.nodes {
+		if strings.HasPrefix(known, prefix) {
+			if knownInfo.IsDir() {
+				w.fsWatcher.Remove(known)
+			}
+			delete(w.nodes, known)
+		}
+	}
+}
+
+// send - builds the folder watch message & sends it, any failure to process
+// it is logged as it would be for a message from the broker
+func (w *Watcher) send(ctx context.Context, action, path string, isDir bool) {
+	folderWatchMsg := rabbitMQ.FolderWatchMessage{
+		Action:      action,
+		Path:        path,
+		IsDir:       fmt.Sprintf("%t", isDir),
+		WatchFolder: w.watchFolderFor(path),
+	}
+	msg, err := json.Marshal(folderWatchMsg)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("path", path).Msg("Failed to marshal folder watch message")
+		return
+	}
+	// each change is logged under its own correlation ID, through to the handler
+	msgCtx := logging.WithCorrelationID(ctx, "")
+	if err := w.Send(msgCtx, msg); err != nil && ctx.Err() == nil {
+		logging.Ctx(msgCtx).Error().Err(err).Str("action", action).Str("path", path).Msg("Failed to process folder watch message")
+	}
+}
+
+// watchFolderFor - the watch folder the path is in
+func (w *Watcher) watchFolderFor(path string) string {
+	path = strings.Split(path, " -> ")[0]
+	for _, folder := range w.Folders {
+		if path == folder || strings.HasPrefix(path, folder+string(filepath.Separator)) {
+			return folder
+		}
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clwilliams/tlCommonMessaging/rabbitMQ"
+)
+
+// testTimeout - how long a test waits for a message before failing
+const testTimeout = 5 * time.Second
+
+// watch - runs a watcher over a new folder until the test ends, returning the
+// folder & the messages it sends
+func watch(t *testing.T) (string, <-chan rabbitMQ.FolderWatchMessage) {
+	folder := t.TempDir()
+	messages := make(chan rabbitMQ.FolderWatchMessage, 100)
+	w := &Watcher{
+		Folders: []string{folder},
+		Send: func(ctx context.Context, msg []byte) error {
+			var folderWatchMsg rabbitMQ.FolderWatchMessage
+			if err := json.Unmarshal(msg, &folderWatchMsg); err != nil {
+				t.Errorf("Sent an invalid message %v", err)
+			}
+			messages <- folderWatchMsg
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if err := w.Run(ctx); err != nil {
+			t.Errorf("Watching failed %v", err)
+		}
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	expect(t, messages, rabbitMQ.CreateAction, folder)
+	return folder, messages
+}
+
+// expect - waits for the next message, which must be the action on the path
+func expect(t *testing.T, messages <-chan rabbitMQ.FolderWatchMessage, action, path string) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		if msg.Action != action || msg.Path != path {
+			t.Fatalf("Sent %s %s, want %s %s", msg.Action, msg.Path, action, path)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("Nothing sent, want %s %s", action, path)
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("pdf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenameIsPairedWithTheSameFile(t *testing.T) {
+	folder, messages := watch(t)
+	oldPath, newPath := filepath.Join(folder, "a.pdf"), filepath.Join(folder, "b.pdf")
+	writeFile(t, oldPath)
+	expect(t, messages, rabbitMQ.CreateAction, oldPath)
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, messages, rabbitMQ.RenameAction, oldPath+" -> "+newPath)
+}
+
+func TestMoveIsPairedWithTheSameFolder(t *testing.T) {
+	folder, messages := watch(t)
+	oldPath, newPath := filepath.Join(folder, "2019"), filepath.Join(folder, "archive")
+	if err := os.MkdirAll(filepath.Join(oldPath, "03 March"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, messages, rabbitMQ.CreateAction, oldPath)
+	expect(t, messages, rabbitMQ.CreateAction, filepath.Join(oldPath, "03 March"))
+	if err := os.Mkdir(newPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, messages, rabbitMQ.CreateAction, newPath)
+
+	if err := os.Rename(oldPath, filepath.Join(newPath, "2019")); err != nil {
+		t.Fatal(err)
+	}
+	// the folder's contents move with it, so aren't sent
+	expect(t, messages, rabbitMQ.MoveAction, oldPath+" -> "+filepath.Join(newPath, "2019"))
+	select {
+	case msg := <-messages:
+		t.Errorf("Sent %s %s, want only the folder's move", msg.Action, msg.Path)
+	case <-time.After(2 * DefaultRenameWindow):
+	}
+}
+
+func TestUnrelatedCreateIsntTakenForARename(t *testing.T) {
+	folder, messages := watch(t)
+	outside := t.TempDir()
+	oldPath, createdPath := filepath.Join(folder, "a.pdf"), filepath.Join(folder, "c.pdf")
+	writeFile(t, oldPath)
+	expect(t, messages, rabbitMQ.CreateAction, oldPath)
+
+	// moved out of the watch folder, as another file turns up beside it
+	if err := os.Rename(oldPath, filepath.Join(outside, "a.pdf")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, createdPath)
+	expect(t, messages, rabbitMQ.CreateAction, createdPath)
+	expect(t, messages, rabbitMQ.DeleteAction, oldPath)
+}